@@ -6,30 +6,17 @@ import (
 	"time"
 
 	"github.com/liornabat/opencensus-poc/stats"
-	"go.opencensus.io/exporter/prometheus"
-	"go.opencensus.io/stats/view"
 )
 
 func main() {
-	go http.ListenAndServe("localhost:8080", nil)
-
-	// Create that Stackdriver stats exporter
-	exporter, err := prometheus.NewExporter(prometheus.Options{})
-	if err != nil {
-		log.Fatalf("Failed to create the Stackdriver stats exporter: %v", err)
-	}
-	http.Handle("/metrics", exporter)
-
-	// Register the stats exporter
-	view.RegisterExporter(exporter)
-
-	view.RegisterExporter(&stats.exporter{})
-	// Register the views
-	view.SetReportingPeriod(1 * time.Second)
-	err = stats.Init("some_node_name")
+	// Register the views and the exporters
+	s, err := stats.Init(stats.WithInternalExporter(), stats.WithPrometheus("", nil), stats.WithExportInterval(1*time.Second))
 	if err != nil {
 		log.Fatalf("Failed to init stats: %v", err)
 	}
+	http.Handle("/metrics", s.GetPrometheusHandler())
+	http.Handle("/stats", s.GetJSONHandler())
+	http.Handle("/stream", s.GetStreamHandler())
 	//key := stats.GetKey(
 	//key2 := stats.GetKey(
 	//keySet := stats.NewSet("some_set").Add(key, key2)
@@ -52,4 +39,5 @@ func main() {
 	//		}
 	//	}
 	//}
+	log.Fatal(http.ListenAndServe("localhost:8080", nil))
 }
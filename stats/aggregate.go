@@ -1,7 +1,6 @@
 package stats
 
 import (
-	"strings"
 	"sync"
 	"time"
 )
@@ -10,9 +9,18 @@ type aggregator interface {
 	insert(values ...interface{})
 	aggregate() (Key, statType, interface{})
 	isTouched() bool
+	// value returns the cumulative value and diff the change since a
+	// previous one, reporting whether anything changed.
+	value() interface{}
+	diff(prev interface{}) (interface{}, bool)
+	index() (Key, statType)
+	add(at time.Time, value interface{}, resolution, retention time.Duration)
+	valueAt(at time.Time) interface{}
 }
 
 type aggCount struct {
+	history
+	ewma
 	st        statType
 	key       Key
 	touched   bool
@@ -54,7 +62,30 @@ func (a *aggCount) aggregate() (Key, statType, interface{}) {
 	return a.key, a.st, int64(0)
 }
 
+func (a *aggCount) observe(at time.Time, tau time.Duration) {
+	a.ewma.observe(at, float64(a.lastValue), tau)
+}
+
+func (a *aggCount) index() (Key, statType) {
+	return a.key, a.st
+}
+
+func (a *aggCount) value() interface{} {
+	return a.lastValue
+}
+
+func (a *aggCount) diff(prev interface{}) (interface{}, bool) {
+	p, _ := prev.(int64)
+	if p > a.lastValue {
+		p = 0
+	}
+	diff := a.lastValue - p
+	return diff, diff > 0
+}
+
 type aggSum struct {
+	history
+	ewma
 	st        statType
 	key       Key
 	touched   bool
@@ -94,7 +125,29 @@ func (a *aggSum) aggregate() (Key, statType, interface{}) {
 	return a.key, a.st, float64(0)
 }
 
+func (a *aggSum) observe(at time.Time, tau time.Duration) {
+	a.ewma.observe(at, a.lastValue, tau)
+}
+
+func (a *aggSum) index() (Key, statType) {
+	return a.key, a.st
+}
+
+func (a *aggSum) value() interface{} {
+	return a.lastValue
+}
+
+func (a *aggSum) diff(prev interface{}) (interface{}, bool) {
+	p, _ := prev.(float64)
+	if p > a.lastValue {
+		p = 0
+	}
+	diff := a.lastValue - p
+	return diff, diff > 0
+}
+
 type aggLastValue struct {
+	history
 	st        statType
 	key       Key
 	touched   bool
@@ -130,14 +183,26 @@ func (a *aggLastValue) aggregate() (Key, statType, interface{}) {
 	return a.key, a.st, lastValue
 }
 
+func (a *aggLastValue) index() (Key, statType) {
+	return a.key, a.st
+}
+
+func (a *aggLastValue) value() interface{} {
+	return a.lastValue
+}
+
+func (a *aggLastValue) diff(prev interface{}) (interface{}, bool) {
+	p, ok := prev.(float64)
+	return a.lastValue, !ok || p != a.lastValue
+}
+
 type ageDistribution struct {
-	st        statType
-	key       Key
-	touched   bool
-	prevCount int64
-	prevSum   float64
-	lastCount int64
-	lastSum   float64
+	history
+	st      statType
+	key     Key
+	touched bool
+	prev    *histogram
+	last    *histogram
 }
 
 func newAgeDistribution(key Key, st statType) *ageDistribution {
@@ -152,117 +217,244 @@ func (a *ageDistribution) isTouched() bool {
 }
 
 func (a *ageDistribution) insert(values ...interface{}) {
-	if len(values) == 2 {
-		lastCount, ok := values[0].(int64)
-		if ok && lastCount != a.lastCount {
-			a.lastCount = lastCount
-			a.touched = true
-		}
-		lastSum, ok := values[1].(float64)
-		if ok && lastSum != a.lastSum {
-			a.lastSum = lastSum
+	if len(values) == 1 {
+		last, ok := values[0].(*histogram)
+		if ok && (a.last == nil || last.count != a.last.count) {
+			a.last = last
 			a.touched = true
 		}
-
 	}
 }
 
 func (a *ageDistribution) aggregate() (Key, statType, interface{}) {
-	diffCount := a.lastCount - a.prevCount
-	a.prevCount = a.lastCount
-
-	diffSum := a.lastSum - a.prevSum
-	a.prevSum = a.lastSum
+	diff := a.last.sub(a.prev)
+	a.prev = a.last
 	a.touched = false
-	if diffCount > 0 {
-		return a.key, a.st, diffSum / float64(diffCount)
-	}
+	return a.key, a.st, diff
+}
 
-	return a.key, a.st, float64(0)
+func (a *ageDistribution) index() (Key, statType) {
+	return a.key, a.st
+}
+
+func (a *ageDistribution) value() interface{} {
+	return a.last
+}
+
+func (a *ageDistribution) diff(prev interface{}) (interface{}, bool) {
+	p, _ := prev.(*histogram)
+	diff := a.last.sub(p)
+	return diff, !diff.isEmpty()
+}
+
+type aggIndex struct {
+	key Key
+	st  statType
 }
 
 type aggMap struct {
 	sync.Mutex
-	m map[string]aggregator
+	m             map[aggIndex]aggregator
+	windows       []time.Duration
+	resolution    time.Duration
+	retention     time.Duration
+	smoothing     time.Duration
+	created       time.Time
+	lastAggregate time.Time
+	// ends and prevEnds hold the end time of the current and previous
+	// reports of each view.
+	ends     map[statType]time.Time
+	prevEnds map[statType]time.Time
+	// newCounter creates the counters of distinct clients, channels, groups
+	// and nodes, exact unless approximate counting is enabled.
+	newCounter func() distinctCounter
 }
 
-func newAggMap() *aggMap {
-	return &aggMap{
-		m: map[string]aggregator{},
+func newAggMap(windows []time.Duration) *aggMap {
+	now := time.Now()
+	a := &aggMap{
+		m:             map[aggIndex]aggregator{},
+		windows:       windows,
+		smoothing:     defaultRateSmoothing,
+		created:       now,
+		lastAggregate: now,
+		ends:          map[statType]time.Time{},
+		prevEnds:      map[statType]time.Time{},
+		newCounter:    newExactCounter,
 	}
+	a.resolution, a.retention = windowResolution(windows)
+	return a
+}
+
+// report marks the start of a report of the view of st ending at end.
+func (a *aggMap) report(st statType, end time.Time) {
+	a.Lock()
+	defer a.Unlock()
+	a.prevEnds[st], a.ends[st] = a.ends[st], end
 }
 
-func (a *aggMap) insert(index string, values ...interface{}) {
+func (a *aggMap) insert(at time.Time, key Key, st statType, values ...interface{}) {
 	a.Lock()
 	defer a.Unlock()
+	index := aggIndex{key: key, st: st}
 	agg, ok := a.m[index]
 	if !ok {
-		params := strings.Split(index, "@@")
-		key := Key(params[0])
-		statName := params[1]
-		switch statName {
-		case "total_messages":
-			agg = newAggSum(key, typeMsgCount)
-		case "total_cache_hits":
-			agg = newAggCount(key, typeCacheHits)
-		case "total_cache_miss":
-			agg = newAggCount(key, typeCacheMiss)
-		case "total_errors":
-			agg = newAggCount(key, typeErrors)
-		case "total_message_size":
-			agg = newAggSum(key, typeMsgSize)
-		case "total_latency":
-			agg = newAgeDistribution(key, typeLatency)
-		case "LastUpdatedUnix":
-			agg = newAggLastValue(key, typeLastUpdate)
+		switch st {
+		case typeMsgCount, typeMsgSize:
+			agg = newAggSum(key, st)
+		case typeCacheHits, typeCacheMiss, typeErrors:
+			agg = newAggCount(key, st)
+		case typeLatency, typeMsgSizeDist:
+			agg = newAgeDistribution(key, st)
+		case typeLastUpdate:
+			agg = newAggLastValue(key, st)
+		default:
+			return
 		}
 		a.m[index] = agg
+		// a new row collected its values since the previous report
+		if r, ok := agg.(rater); ok && !a.prevEnds[st].IsZero() {
+			r.observe(a.prevEnds[st], a.smoothing)
+		}
 	}
 	agg.insert(values...)
+	if a.retention > 0 {
+		agg.add(at, agg.value(), a.resolution, a.retention)
+	}
+	if r, ok := agg.(rater); ok {
+		r.observe(at, a.smoothing)
+	}
+}
+
+// evict removes the aggregators of the keys.
+func (a *aggMap) evict(keys []Key) {
+	a.Lock()
+	defer a.Unlock()
+	for _, key := range keys {
+		for st := range typeNames {
+			delete(a.m, aggIndex{key: key, st: st})
+		}
+	}
 }
 
 func (a *aggMap) GetChannelSummaryMap() (map[string]*ChannelSummary, Summary) {
 	a.Lock()
 	defer a.Unlock()
-	metricsMap := make(map[string]*ChannelSummary)
-	summery := Summary{}
+	now := time.Now()
+	span := now.Sub(a.lastAggregate)
+	a.lastAggregate = now
+	b := newSummaryBuilder(a.newCounter, query{})
 	for _, agg := range a.m {
 		if agg.isTouched() {
-			key, st, value := agg.aggregate()
-			metric, ok := metricsMap[key.String()]
-			if !ok {
-				metric = NewChannelSummary(key)
-				metricsMap[key.String()] = metric
-			}
-			switch st {
-			case typeMsgCount:
-				metric.TotalMsgCount = value.(float64)
-			case typeMsgSize:
-				metric.TotalMsgSize = value.(float64)
-			case typeCacheHits:
-				metric.TotalCacheHits = value.(int64)
-			case typeCacheMiss:
-				metric.TotalCacheMiss = value.(int64)
-			case typeErrors:
-				metric.TotalErrors = value.(int64)
-			case typeLatency:
-				metric.AvgLatency = value.(float64)
-			case typeLastUpdate:
-				metric.LastUpdatedUnix = int64(value.(float64))
-				metric.LastUpdateTime = time.Unix(metric.LastUpdatedUnix, 0)
-			}
-			if metric.TotalMsgCount > 0 {
-				metric.AvgMsgSize = metric.TotalMsgSize / metric.TotalMsgCount
-				metric.ErrorRate = float64(metric.TotalErrors) / metric.TotalMsgCount * 100
-			}
-
-			metric.SuccessRate = 100 - metric.ErrorRate
-			if metric.TotalCacheHits+metric.TotalCacheMiss > 0 {
-				metric.CacheHitsRatio = float64(metric.TotalCacheHits) / float64(metric.TotalCacheHits+metric.TotalCacheMiss)
-			}
-			summery = summery.AddSummary(metric)
+			b.add(agg.aggregate())
+			addRate(b, agg)
+		}
+	}
+	return b.build(span)
+}
+
+func addRate(b *summaryBuilder, agg aggregator) {
+	if r, ok := agg.(rater); ok {
+		key, st := agg.index()
+		b.addRate(key, st, r.rate())
+	}
+}
+
+// GetWindowSummaryMap returns the summaries of the keys selected by q active
+// in the last d, without affecting GetChannelSummaryMap or other windows.
+func (a *aggMap) GetWindowSummaryMap(d time.Duration, q query) (map[string]*ChannelSummary, Summary) {
+	a.Lock()
+	defer a.Unlock()
+	since := time.Now().Add(-d)
+	return a.build(d, q, func(index aggIndex, agg aggregator) (interface{}, bool) {
+		return agg.diff(agg.valueAt(since))
+	})
+}
+
+// GetSnapshot returns the cumulative summaries of the keys selected by q.
+func (a *aggMap) GetSnapshot(q query) (map[string]*ChannelSummary, Summary) {
+	a.Lock()
+	defer a.Unlock()
+	return a.build(time.Since(a.created), q, func(index aggIndex, agg aggregator) (interface{}, bool) {
+		return agg.diff(nil)
+	})
+}
+
+// GetDelta returns the summaries of what changed since the cursor, and the
+// cursor to pass to the next call. A nil cursor returns the cumulative values.
+func (a *aggMap) GetDelta(since *Cursor) (map[string]*ChannelSummary, Summary, *Cursor) {
+	a.Lock()
+	defer a.Unlock()
+	next := a.cursor()
+	m, sum := a.delta(since, next, query{})
+	return m, sum, next
+}
+
+// GetCursor returns a cursor at the current values.
+func (a *aggMap) GetCursor() *Cursor {
+	a.Lock()
+	defer a.Unlock()
+	return a.cursor()
+}
+
+// GetDeltaQuery returns the summaries of the keys selected by q that changed
+// between the cursors. Nothing must have been inserted since until was taken.
+func (a *aggMap) GetDeltaQuery(since, until *Cursor, q query) (map[string]*ChannelSummary, Summary) {
+	a.Lock()
+	defer a.Unlock()
+	return a.delta(since, until, q)
+}
+
+func (a *aggMap) cursor() *Cursor {
+	c := &Cursor{
+		at:     time.Now(),
+		values: make(map[aggIndex]interface{}, len(a.m)),
+	}
+	for index, agg := range a.m {
+		c.values[index] = agg.value()
+	}
+	return c
+}
+
+// delta folds what changed since the cursor into summaries, with the rates
+// computed up to until.
+func (a *aggMap) delta(since, until *Cursor, q query) (map[string]*ChannelSummary, Summary) {
+	span := until.at.Sub(a.created)
+	if since != nil {
+		span = until.at.Sub(since.at)
+	}
+	return a.build(span, q, func(index aggIndex, agg aggregator) (interface{}, bool) {
+		var prev interface{}
+		if since != nil {
+			prev = since.values[index]
 		}
+		return agg.diff(prev)
+	})
+}
 
+// build folds the value returned by f for every aggregator into summaries.
+// Keys are only included when f reports a change for one of their stats. Rates
+// are computed over span.
+func (a *aggMap) build(span time.Duration, q query, f func(index aggIndex, agg aggregator) (interface{}, bool)) (map[string]*ChannelSummary, Summary) {
+	type result struct {
+		index aggIndex
+		value interface{}
+	}
+	results := make([]result, 0, len(a.m))
+	active := make(map[Key]bool)
+	for index, agg := range a.m {
+		value, changed := f(index, agg)
+		if changed {
+			active[index.key] = true
+		}
+		results = append(results, result{index: index, value: value})
+	}
+	b := newSummaryBuilder(a.newCounter, q)
+	for _, r := range results {
+		if active[r.index.key] {
+			b.add(r.index.key, r.index.st, r.value)
+			addRate(b, a.m[r.index])
+		}
 	}
-	return metricsMap, summery
+	return b.build(span)
 }
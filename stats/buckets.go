@@ -0,0 +1,42 @@
+package stats
+
+import "fmt"
+
+var (
+	defaultLatencyBuckets = []float64{0, 25, 50, 75, 100, 200, 400, 600, 800, 1000, 2000, 4000, 6000}
+	defaultMsgSizeBuckets = []float64{0, 64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304}
+)
+
+// ExponentialBuckets returns count bounds where the first one is start and
+// every following one is factor times the previous.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, 0, count)
+	for i := 0; i < count; i++ {
+		buckets = append(buckets, start)
+		start *= factor
+	}
+	return buckets
+}
+
+// LinearBuckets returns count bounds where the first one is start and every
+// following one is width larger than the previous.
+func LinearBuckets(start, width float64, count int) []float64 {
+	buckets := make([]float64, 0, count)
+	for i := 0; i < count; i++ {
+		buckets = append(buckets, start)
+		start += width
+	}
+	return buckets
+}
+
+func checkBuckets(st statType, buckets []float64) error {
+	if len(buckets) == 0 {
+		return fmt.Errorf("stats: no buckets set for %s", st)
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return fmt.Errorf("stats: buckets for %s must be in increasing order", st)
+		}
+	}
+	return nil
+}
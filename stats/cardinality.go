@@ -0,0 +1,313 @@
+package stats
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opencensus.io/stats/view"
+)
+
+const overflowValue = "__overflow__"
+
+// OverflowKey is the key the recordings of new keys are folded into once the
+// limit set with WithMaxKeys is reached.
+var OverflowKey = GetKey("", overflowValue, overflowValue, "", "", "")
+
+// KeyCounters are the counters of the keys of an instance.
+type KeyCounters struct {
+	// Live is the number of keys currently tracked.
+	Live int
+	// Evicted is the number of keys evicted after being idle for the TTL set
+	// with WithKeyTTL.
+	Evicted uint64
+	// Folded is the number of distinct keys folded into OverflowKey. It is
+	// estimated with a HyperLogLog, within about 1% past a few thousand keys.
+	Folded uint64
+}
+
+// cacheShards is the number of shards of a contextCache, so recordings of
+// different keys rarely contend on the same lock.
+const cacheShards = 64
+
+// foldedPrecision is the precision of the HyperLogLog counting the folded
+// keys, which takes 16KB.
+const foldedPrecision = 14
+
+// contextCache holds the tag context of every key recorded by an instance. It
+// admits at most maxKeys keys, folding the recordings of the others into
+// OverflowKey, and evicts the keys idle for ttl. Both are unlimited when zero.
+// Keys are spread over shards by hash, and a cache hit only takes the read
+// lock of its shard.
+type contextCache struct {
+	shards   [cacheShards]cacheShard
+	maxKeys  int64
+	ttl      time.Duration
+	overflow context.Context
+	declared tagKeySet
+	// now is the time of the last sweep in nanoseconds, which stamps the
+	// entries recorded until the next one so the hot path does not read the
+	// clock. Idle times are thus measured at the sweep interval.
+	now int64
+
+	live, evicted int64
+
+	foldedMu sync.Mutex
+	folded   *hyperLogLog
+}
+
+type cacheShard struct {
+	sync.RWMutex
+	m map[Key]*cacheEntry
+	// pad keeps the shards on separate cache lines
+	_ [32]byte
+}
+
+type cacheEntry struct {
+	ctx  context.Context
+	seen int64
+}
+
+func newContextCache(maxKeys int, ttl time.Duration, declared tagKeySet) *contextCache {
+	cc := &contextCache{
+		declared: declared,
+		maxKeys:  int64(maxKeys),
+		ttl:      ttl,
+		now:      time.Now().UnixNano(),
+		folded:   newHyperLogLog(foldedPrecision),
+	}
+	for i := range cc.shards {
+		cc.shards[i].m = make(map[Key]*cacheEntry)
+	}
+	// the overflow key has no labels, its context cannot fail
+	cc.overflow, _ = OverflowKey.context(context.Background(), declared)
+	return cc
+}
+
+func (cc *contextCache) shard(key Key) *cacheShard {
+	// FNV-1a over the fields, which does not allocate
+	h := uint32(2166136261)
+	for _, f := range [...]string{key.node, key.clientID, key.channel, key.group, key.kind, key.subKind, key.labels} {
+		for i := 0; i < len(f); i++ {
+			h ^= uint32(f[i])
+			h *= 16777619
+		}
+		// a zero byte between the fields
+		h *= 16777619
+	}
+	return &cc.shards[h%cacheShards]
+}
+
+func (cc *contextCache) get(key Key) (context.Context, error) {
+	sh := cc.shard(key)
+	sh.RLock()
+	e, ok := sh.m[key]
+	sh.RUnlock()
+	if ok {
+		if cc.ttl > 0 {
+			if now := atomic.LoadInt64(&cc.now); atomic.LoadInt64(&e.seen) != now {
+				atomic.StoreInt64(&e.seen, now)
+			}
+		}
+		return e.ctx, nil
+	}
+	sh.Lock()
+	defer sh.Unlock()
+	if e, ok := sh.m[key]; ok {
+		return e.ctx, nil
+	}
+	if live := atomic.AddInt64(&cc.live, 1); cc.maxKeys > 0 && live > cc.maxKeys {
+		atomic.AddInt64(&cc.live, -1)
+		cc.foldedMu.Lock()
+		cc.folded.add(key.String())
+		cc.foldedMu.Unlock()
+		return cc.overflow, nil
+	}
+	ctx, err := key.context(context.Background(), cc.declared)
+	if err != nil {
+		atomic.AddInt64(&cc.live, -1)
+		return context.TODO(), err
+	}
+	sh.m[key] = &cacheEntry{ctx: ctx, seen: atomic.LoadInt64(&cc.now)}
+	return ctx, nil
+}
+
+// sweep evicts the keys idle since before now minus the TTL and returns them.
+func (cc *contextCache) sweep(now time.Time) []Key {
+	if cc.ttl <= 0 {
+		return nil
+	}
+	atomic.StoreInt64(&cc.now, now.UnixNano())
+	cutoff := now.Add(-cc.ttl).UnixNano()
+	var evicted []Key
+	for i := range cc.shards {
+		sh := &cc.shards[i]
+		sh.Lock()
+		for key, e := range sh.m {
+			if atomic.LoadInt64(&e.seen) <= cutoff {
+				delete(sh.m, key)
+				evicted = append(evicted, key)
+			}
+		}
+		sh.Unlock()
+	}
+	atomic.AddInt64(&cc.live, -int64(len(evicted)))
+	atomic.AddInt64(&cc.evicted, int64(len(evicted)))
+	return evicted
+}
+
+func (cc *contextCache) has(key Key) bool {
+	sh := cc.shard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	_, ok := sh.m[key]
+	return ok
+}
+
+func (cc *contextCache) counters() KeyCounters {
+	cc.foldedMu.Lock()
+	folded := cc.folded.count()
+	cc.foldedMu.Unlock()
+	return KeyCounters{
+		Live:    int(atomic.LoadInt64(&cc.live)),
+		Evicted: uint64(atomic.LoadInt64(&cc.evicted)),
+		Folded:  uint64(folded),
+	}
+}
+
+// KeyCounters returns the counters of the keys of s.
+func (s *Stats) KeyCounters() KeyCounters {
+	return s.ctxCache.counters()
+}
+
+// evict evicts the idle keys from the key cache and the internal exporter,
+// and drops their rows from the views.
+func (s *Stats) evict() {
+	keys := s.ctxCache.sweep(time.Now())
+	if len(keys) == 0 {
+		return
+	}
+	if s.internalExporter != nil {
+		s.internalExporter.aggMap.evict(keys)
+	}
+	if err := s.compact(keys); err != nil && s.opts.errFunc != nil {
+		s.opts.errFunc(err)
+	}
+}
+
+// compact drops the rows of the evicted keys from the views. Views cannot
+// drop rows, so compact registers the views of the other generation, swaps
+// them in while no recording is in flight, and adds the data of the previous
+// views to base for the keys that are still tracked. The exporters get the
+// sum of base and the current views, so the cumulative values of the
+// remaining keys go on.
+func (s *Stats) compact(evicted []Key) error {
+	dropped := make(map[Key]bool, len(evicted))
+	for _, key := range evicted {
+		dropped[key] = true
+	}
+	prev := s.views
+	s.recordMu.Lock()
+	err := s.registerViews(1 - s.gen)
+	s.recordMu.Unlock()
+	if err != nil {
+		return err
+	}
+	base := make(map[statType]map[Key]*view.Row, len(prev))
+	for st, v := range prev {
+		rows, err := view.RetrieveData(v.Name)
+		view.Unregister(v)
+		if err != nil {
+			return err
+		}
+		base[st] = make(map[Key]*view.Row)
+		for key, row := range s.base[st] {
+			if !dropped[key] || s.ctxCache.has(key) {
+				base[st][key] = row
+			}
+		}
+		for _, row := range rows {
+			key := makeKeyFromTags(row.Tags)
+			if !dropped[key] || s.ctxCache.has(key) {
+				base[st][key] = addRow(base[st][key], row)
+			}
+		}
+	}
+	s.base = base
+	return nil
+}
+
+// withBase returns rows with the data of base added.
+func (s *Stats) withBase(st statType, rows []*view.Row) []*view.Row {
+	base := s.base[st]
+	if len(base) == 0 {
+		return rows
+	}
+	merged := make([]*view.Row, 0, len(base)+len(rows))
+	seen := make(map[Key]bool, len(rows))
+	for _, row := range rows {
+		key := makeKeyFromTags(row.Tags)
+		seen[key] = true
+		merged = append(merged, addRow(base[key], row))
+	}
+	for key, row := range base {
+		if !seen[key] {
+			merged = append(merged, row)
+		}
+	}
+	return merged
+}
+
+// addRow returns the row of the data of row added to the data of base, which
+// can be nil. Last values are replaced.
+func addRow(base, row *view.Row) *view.Row {
+	if base == nil {
+		return row
+	}
+	sum := &view.Row{Tags: row.Tags, Data: row.Data}
+	switch v := row.Data.(type) {
+	case *view.CountData:
+		if b, ok := base.Data.(*view.CountData); ok {
+			sum.Data = &view.CountData{Value: b.Value + v.Value}
+		}
+	case *view.SumData:
+		if b, ok := base.Data.(*view.SumData); ok {
+			sum.Data = &view.SumData{Value: b.Value + v.Value}
+		}
+	case *view.DistributionData:
+		if b, ok := base.Data.(*view.DistributionData); ok {
+			sum.Data = addDistribution(b, v)
+		}
+	}
+	return sum
+}
+
+// addDistribution merges two distributions of the same buckets, combining the
+// squared deviations as for a parallel variance.
+func addDistribution(a, b *view.DistributionData) *view.DistributionData {
+	if a.Count == 0 {
+		return b
+	}
+	if b.Count == 0 {
+		return a
+	}
+	n := float64(a.Count + b.Count)
+	delta := b.Mean - a.Mean
+	d := &view.DistributionData{
+		Count:           a.Count + b.Count,
+		Min:             math.Min(a.Min, b.Min),
+		Max:             math.Max(a.Max, b.Max),
+		Mean:            a.Mean + delta*float64(b.Count)/n,
+		SumOfSquaredDev: a.SumOfSquaredDev + b.SumOfSquaredDev + delta*delta*float64(a.Count)*float64(b.Count)/n,
+		CountPerBucket:  make([]int64, len(a.CountPerBucket)),
+	}
+	copy(d.CountPerBucket, a.CountPerBucket)
+	for i := range b.CountPerBucket {
+		if i < len(d.CountPerBucket) {
+			d.CountPerBucket[i] += b.CountPerBucket[i]
+		}
+	}
+	return d
+}
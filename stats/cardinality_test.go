@@ -0,0 +1,116 @@
+package stats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+)
+
+func TestStats_MaxKeys(t *testing.T) {
+	_, err := New(WithMaxKeys(-1))
+	require.Error(t, err)
+	s, err := New(WithExportInterval(10*time.Millisecond), WithInternalExporter(), WithMaxKeys(2))
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+
+	keys := []Key{
+		GetKey("node_max", "client_max_1", "some_channel", "", "publish", ""),
+		GetKey("node_max", "client_max_2", "some_channel", "", "publish", ""),
+		GetKey("node_max", "client_max_3", "some_channel", "", "publish", ""),
+	}
+	for i, key := range keys {
+		require.NoError(t, s.Record(key, Item{MsgCount: float64(i + 1)}))
+	}
+	require.NoError(t, s.Record(keys[0], Item{MsgCount: 10}))
+	time.Sleep(100 * time.Millisecond)
+
+	m, _ := s.Snapshot()
+	require.Len(t, m, 3)
+	assert.EqualValues(t, 11, m[keys[0].String()].TotalMsgCount)
+	assert.EqualValues(t, 2, m[keys[1].String()].TotalMsgCount)
+	assert.NotContains(t, m, keys[2].String())
+	require.Contains(t, m, OverflowKey.String())
+	assert.EqualValues(t, 3, m[OverflowKey.String()].TotalMsgCount)
+	assert.Equal(t, KeyCounters{Live: 2, Folded: 1}, s.KeyCounters())
+
+	// folded keys are counted once
+	require.NoError(t, s.Record(keys[2], Item{MsgCount: 1}))
+	require.NoError(t, s.Record(GetKey("node_max", "client_max_4", "some_channel", "", "publish", ""), Item{MsgCount: 1}))
+	assert.Equal(t, KeyCounters{Live: 2, Folded: 2}, s.KeyCounters())
+}
+
+func TestKey_RecordWithContextMaxKeys(t *testing.T) {
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter(), WithMaxKeys(1))
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+
+	live := GetKey("node_ctx", "client_ctx_1", "some_channel", "", "publish", "")
+	folded := GetKey("node_ctx", "client_ctx_2", "some_channel", "", "publish", "")
+	require.NoError(t, s.Record(live, Item{MsgCount: 1}))
+	ctx, err := folded.context(context.Background(), s.declared)
+	require.NoError(t, err)
+	require.NoError(t, folded.RecordWithContext(ctx, Item{MsgCount: 2}))
+	time.Sleep(100 * time.Millisecond)
+
+	m, _ := s.Snapshot()
+	assert.NotContains(t, m, folded.String())
+	require.Contains(t, m, OverflowKey.String())
+	assert.EqualValues(t, 2, m[OverflowKey.String()].TotalMsgCount)
+	assert.Equal(t, KeyCounters{Live: 1, Folded: 1}, s.KeyCounters())
+}
+
+func TestStats_KeyTTL(t *testing.T) {
+	s, err := New(WithExportInterval(20*time.Millisecond), WithInternalExporter(), WithKeyTTL(150*time.Millisecond))
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+
+	idle := GetKey("node_ttl", "client_ttl_idle", "some_channel", "", "publish", "")
+	busy := GetKey("node_ttl", "client_ttl_busy", "some_channel", "", "publish", "")
+	require.NoError(t, s.Record(idle, Item{MsgCount: 1}))
+	for i := 0; i < 15; i++ {
+		require.NoError(t, s.Record(busy, Item{MsgCount: 1, Latency: time.Millisecond}))
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(40 * time.Millisecond)
+
+	m, _ := s.Snapshot()
+	assert.NotContains(t, m, idle.String())
+	require.Contains(t, m, busy.String())
+	// the cumulative values go on across the views replaced to drop the idle
+	// key
+	assert.EqualValues(t, 15, m[busy.String()].TotalMsgCount)
+	assert.InDelta(t, 1, m[busy.String()].AvgLatency, 0.001)
+	rows, err := view.RetrieveData(s.views[typeMsgCount].Name)
+	require.NoError(t, err)
+	rows = s.withBase(typeMsgCount, rows)
+	require.Len(t, rows, 1)
+	assert.Equal(t, busy, makeKeyFromTags(rows[0].Tags))
+	assert.Equal(t, &view.SumData{Value: 15}, rows[0].Data)
+	counters := s.KeyCounters()
+	assert.Equal(t, 1, counters.Live)
+	assert.EqualValues(t, 1, counters.Evicted)
+
+	// an evicted key starts over
+	require.NoError(t, s.Record(idle, Item{MsgCount: 2}))
+	time.Sleep(50 * time.Millisecond)
+	m, _ = s.Snapshot()
+	require.Contains(t, m, idle.String())
+	assert.EqualValues(t, 2, m[idle.String()].TotalMsgCount)
+}
+
+func TestAddDistribution(t *testing.T) {
+	a := &view.DistributionData{Count: 2, Min: 1, Max: 3, Mean: 2, SumOfSquaredDev: 2, CountPerBucket: []int64{1, 1}}
+	b := &view.DistributionData{Count: 2, Min: 5, Max: 7, Mean: 6, SumOfSquaredDev: 2, CountPerBucket: []int64{0, 2}}
+	d := addDistribution(a, b)
+	// values 1, 3, 5 and 7
+	assert.EqualValues(t, 4, d.Count)
+	assert.Equal(t, 1.0, d.Min)
+	assert.Equal(t, 7.0, d.Max)
+	assert.Equal(t, 4.0, d.Mean)
+	assert.Equal(t, 20.0, d.SumOfSquaredDev)
+	assert.Equal(t, []int64{1, 3}, d.CountPerBucket)
+}
@@ -0,0 +1,139 @@
+package stats
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// distinctCounter counts the distinct values added to it.
+type distinctCounter interface {
+	add(value string)
+	count() int64
+}
+
+type exactCounter map[string]struct{}
+
+func newExactCounter() distinctCounter {
+	return exactCounter{}
+}
+
+func (c exactCounter) add(value string) {
+	c[value] = struct{}{}
+}
+
+func (c exactCounter) count() int64 {
+	return int64(len(c))
+}
+
+// hyperLogLog estimates the number of distinct values in 2^precision bytes,
+// with a standard error of about 1.04/sqrt(2^precision).
+type hyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+func newHyperLogLog(precision uint8) *hyperLogLog {
+	if precision < 4 {
+		precision = 4
+	}
+	if precision > 16 {
+		precision = 16
+	}
+	return &hyperLogLog{
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}
+}
+
+func (h *hyperLogLog) add(value string) {
+	f := fnv.New64a()
+	f.Write([]byte(value))
+	x := mix64(f.Sum64())
+	index := x >> (64 - h.precision)
+	rank := uint8(1)
+	for w := x << h.precision; w&(1<<63) == 0 && rank <= 64-h.precision; w <<= 1 {
+		rank++
+	}
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+func (h *hyperLogLog) count() int64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+// mix64 spreads the bits of an fnv hash, whose high bits are poorly mixed
+// for short inputs.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// activeCounters counts the distinct nodes, clients, channels and groups of a
+// set of keys.
+type activeCounters struct {
+	nodes    distinctCounter
+	clients  distinctCounter
+	channels distinctCounter
+	groups   distinctCounter
+}
+
+func newActiveCounters(newCounter func() distinctCounter) *activeCounters {
+	return &activeCounters{
+		nodes:    newCounter(),
+		clients:  newCounter(),
+		channels: newCounter(),
+		groups:   newCounter(),
+	}
+}
+
+func (c *activeCounters) add(key Key) {
+	if key.node != "" {
+		c.nodes.add(key.node)
+	}
+	if key.clientID != "" {
+		c.clients.add(key.clientID)
+	}
+	if key.channel != "" {
+		c.channels.add(key.channel)
+	}
+	if key.group != "" {
+		c.groups.add(key.channel + separator + key.group)
+	}
+}
+
+func (c *activeCounters) set(s *Summary) {
+	s.TotalActiveNodes = c.nodes.count()
+	s.TotalActiveClients = c.clients.count()
+	s.TotalActiveChannels = c.channels.count()
+	s.TotalActiveGroups = c.groups.count()
+}
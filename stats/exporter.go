@@ -1,35 +1,151 @@
 package stats
 
 import (
-	"fmt"
+	"sync"
+	"time"
 
 	"go.opencensus.io/stats/view"
 )
 
 type exporter struct {
 	aggMap *aggMap
+
+	// interval is the reporting period of the views, see endCycle.
+	interval time.Duration
+
+	mu sync.Mutex
+	// reported holds the views exported during the current reporting cycle,
+	// which started at start.
+	reported  map[statType]bool
+	start     time.Time
+	cursor    *Cursor
+	callbacks []func(map[string]*ChannelSummary, Summary)
+	// hooks are called at the end of every cycle with the cursors taken at
+	// the end of the previous one and of this one.
+	hooks []func(since, until *Cursor)
 }
 
-func NewExporter() *exporter {
+// NewExporter returns the internal exporter. It keeps rolling windows of the
+// given durations, or of 1, 5 and 15 minutes when none are given.
+func NewExporter(windows ...time.Duration) *exporter {
+	if len(windows) == 0 {
+		windows = defaultWindows
+	}
 	return &exporter{
-		aggMap: newAggMap(),
+		aggMap:   newAggMap(windows),
+		reported: make(map[statType]bool),
 	}
 }
 
 func (e *exporter) ExportView(vd *view.Data) {
+	st, ok := statTypeOf(vd.View.Name)
+	if !ok {
+		return
+	}
+	e.startReport(st, vd.End)
+	e.aggMap.report(st, vd.End)
 	for _, row := range vd.Rows {
 		key := makeKeyFromTags(row.Tags)
-		index := fmt.Sprintf("%s@@%s", key.String(), vd.View.Name)
 		switch v := row.Data.(type) {
 		case *view.DistributionData:
-			e.aggMap.insert(index, v.Count, v.Sum())
+			e.aggMap.insert(vd.End, key, st, newHistogram(vd.View.Aggregation.Buckets, v))
 		case *view.CountData:
-			e.aggMap.insert(index, v.Value)
+			e.aggMap.insert(vd.End, key, st, v.Value)
 		case *view.SumData:
-			e.aggMap.insert(index, v.Value)
+			e.aggMap.insert(vd.End, key, st, v.Value)
 		case *view.LastValueData:
-			e.aggMap.insert(index, v.Value)
+			e.aggMap.insert(vd.End, key, st, v.Value)
 		}
 
 	}
+	if e.endReport(st) {
+		e.endCycle()
+	}
+}
+
+// startReport starts a new cycle if the current one ended without exporting
+// every view: st was already exported during it, or it started more than half
+// an interval before end, as when the exporter was registered in the middle of
+// a cycle. What changed during an incomplete cycle is passed to the callbacks
+// with the next one.
+func (e *exporter) startReport(st statType, end time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.reported) == 0 {
+		e.start = end
+		return
+	}
+	if e.reported[st] || e.interval > 0 && end.Sub(e.start) > e.interval/2 {
+		e.reported = make(map[statType]bool)
+		e.start = end
+	}
+}
+
+// endReport records that st was exported and reports whether every view was
+// exported during the current cycle.
+func (e *exporter) endReport(st statType) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reported[st] = true
+	return len(e.reported) == len(typeNames)
+}
+
+// endCycle starts a new reporting cycle and calls the callbacks with what
+// changed during the one that ended, then the hooks.
+func (e *exporter) endCycle() {
+	e.mu.Lock()
+	e.reported = make(map[statType]bool)
+	callbacks, hooks := e.callbacks, e.hooks
+	if len(callbacks) == 0 && len(hooks) == 0 {
+		e.mu.Unlock()
+		return
+	}
+	since := e.cursor
+	var m map[string]*ChannelSummary
+	var sum Summary
+	until := e.aggMap.GetCursor()
+	if len(callbacks) > 0 {
+		m, sum = e.aggMap.GetDeltaQuery(since, until, query{})
+	}
+	e.cursor = until
+	e.mu.Unlock()
+	for _, f := range callbacks {
+		f(m, sum)
+	}
+	for _, f := range hooks {
+		f(since, until)
+	}
+}
+
+// flush ends the current cycle if any view was exported during it.
+func (e *exporter) flush() {
+	e.mu.Lock()
+	pending := len(e.reported) > 0
+	e.mu.Unlock()
+	if pending {
+		e.endCycle()
+	}
+}
+
+func (e *exporter) onInterval(f func(map[string]*ChannelSummary, Summary)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.startCursor()
+	e.callbacks = append(e.callbacks, f)
+}
+
+// onCycle registers f to be called at the end of every cycle, when the
+// aggregated values are those of a whole number of cycles. The values do not
+// change until f returns, so it can read them between the two cursors.
+func (e *exporter) onCycle(f func(since, until *Cursor)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.startCursor()
+	e.hooks = append(e.hooks, f)
+}
+
+func (e *exporter) startCursor() {
+	if e.cursor == nil {
+		e.cursor = e.aggMap.GetCursor()
+	}
 }
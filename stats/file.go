@@ -0,0 +1,388 @@
+package stats
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileFormat is the format of the records written by the file exporter.
+type FileFormat int
+
+const (
+	// FileFormatJSON writes a JSON object per line.
+	FileFormatJSON FileFormat = iota
+	// FileFormatCSV writes comma separated values, with a header at the
+	// beginning of every file.
+	FileFormatCSV
+)
+
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+// FileOptions configures the file exporter enabled with WithFileExporter.
+type FileOptions struct {
+	// Path of the file the records are appended to. Rotated files are
+	// renamed to Path followed by a timestamp.
+	Path string
+	// Format of the records, JSON Lines by default.
+	Format FileFormat
+	// Interval between two writes, the export interval by default. Every
+	// write appends the summaries of the keys that changed since the previous
+	// one over whole reporting cycles, so Interval is rounded to a multiple of
+	// the export interval.
+	Interval time.Duration
+	// MaxSize rotates the file once it reaches this many bytes, never when 0.
+	MaxSize int64
+	// MaxAge rotates the file once it was opened for this long, never when 0.
+	MaxAge time.Duration
+	// Compress gzips the rotated files.
+	Compress bool
+	// MaxBackups is the number of rotated files kept, all of them when 0.
+	MaxBackups int
+	// OnError is called when writing or rotating fails, the error is logged
+	// by default.
+	OnError func(err error)
+}
+
+// fileRecord is a line of a JSON Lines file.
+type fileRecord struct {
+	Time time.Time `json:"time"`
+	*ChannelSummary
+}
+
+// fileExporter appends the summaries of every interval to a file, rotating it
+// by size and age. It reads the internal exporter with its own cursor at the
+// end of the reporting cycles, and writes from its own goroutine.
+type fileExporter struct {
+	opts   FileOptions
+	aggMap *aggMap
+	// cycles is the number of reporting cycles per write, counted by cycle.
+	cycles int
+	cycle  int
+	cursor *Cursor
+
+	mu      sync.Mutex
+	pending []fileBatch
+	ready   chan struct{}
+
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// fileBatch is the summaries of a write.
+type fileBatch struct {
+	at time.Time
+	m  map[string]*ChannelSummary
+}
+
+func newFileExporter(s *Stats, opts FileOptions) (*fileExporter, error) {
+	if opts.Path == "" {
+		return nil, errors.New("stats: file exporter needs a path")
+	}
+	if s.internalExporter == nil {
+		return nil, errors.New("stats: file exporter needs the internal exporter")
+	}
+	if opts.Format != FileFormatJSON && opts.Format != FileFormatCSV {
+		return nil, fmt.Errorf("stats: invalid file format %d", opts.Format)
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = s.opts.exportInterval
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(err error) {
+			log.Printf("Failed to export to file: %v", err)
+		}
+	}
+	cycles := int((opts.Interval + s.opts.exportInterval/2) / s.opts.exportInterval)
+	if cycles < 1 {
+		cycles = 1
+	}
+	e := &fileExporter{
+		opts:   opts,
+		aggMap: s.internalExporter.aggMap,
+		cycles: cycles,
+		ready:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if err := e.open(); err != nil {
+		return nil, err
+	}
+	e.cursor = e.aggMap.GetCursor()
+	s.internalExporter.onCycle(e.endCycle)
+	e.wg.Add(1)
+	go e.run()
+	return e, nil
+}
+
+// endCycle queues the summaries since the previous write every cycles
+// reporting cycles.
+func (e *fileExporter) endCycle(_, until *Cursor) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.cycle++; e.cycle < e.cycles {
+		return
+	}
+	e.queue(until)
+}
+
+// queue queues the summaries between the cursor and until, and starts a new
+// interval. e.mu must be held.
+func (e *fileExporter) queue(until *Cursor) {
+	m, _ := e.aggMap.GetDeltaQuery(e.cursor, until, query{})
+	e.cursor, e.cycle = until, 0
+	e.pending = append(e.pending, fileBatch{at: until.Time(), m: m})
+	select {
+	case e.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (e *fileExporter) run() {
+	defer e.wg.Done()
+	for {
+		select {
+		case <-e.ready:
+			e.exportPending()
+		case <-e.done:
+			e.exportPending()
+			if err := e.file.Close(); err != nil {
+				e.opts.OnError(err)
+			}
+			return
+		}
+	}
+}
+
+func (e *fileExporter) exportPending() {
+	e.mu.Lock()
+	pending := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+	for _, batch := range pending {
+		e.export(batch)
+	}
+}
+
+// export writes the summaries of the batch and rotates the file when needed.
+func (e *fileExporter) export(batch fileBatch) {
+	if e.opts.MaxAge > 0 && time.Since(e.opened) >= e.opts.MaxAge && e.size > 0 {
+		e.rotate()
+	}
+	keys := make([]string, 0, len(batch.m))
+	for k := range batch.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := e.write(batch.at, batch.m[k]); err != nil {
+			e.opts.OnError(err)
+			return
+		}
+	}
+	if e.opts.MaxSize > 0 && e.size >= e.opts.MaxSize {
+		e.rotate()
+	}
+}
+
+func (e *fileExporter) write(at time.Time, cs *ChannelSummary) error {
+	var line []byte
+	switch e.opts.Format {
+	case FileFormatJSON:
+		b, err := json.Marshal(fileRecord{Time: at, ChannelSummary: cs})
+		if err != nil {
+			return err
+		}
+		line = append(b, '\n')
+	case FileFormatCSV:
+		line = csvLine(append([]string{at.Format(time.RFC3339Nano)}, csvValues(cs)...))
+	}
+	n, err := e.file.Write(line)
+	e.size += int64(n)
+	return err
+}
+
+// open opens the file at Path, writing the CSV header when it is new.
+func (e *fileExporter) open() error {
+	f, err := os.OpenFile(e.opts.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	e.file, e.size, e.opened = f, info.Size(), time.Now()
+	if e.opts.Format == FileFormatCSV && e.size == 0 {
+		n, err := f.Write(csvLine(append([]string{"time"}, csvHeader...)))
+		e.size += int64(n)
+		return err
+	}
+	return nil
+}
+
+// rotate renames the file, compresses it if required, removes the rotated
+// files beyond MaxBackups and opens a new file.
+func (e *fileExporter) rotate() {
+	if err := e.file.Close(); err != nil {
+		e.opts.OnError(err)
+	}
+	rotated := e.opts.Path + "." + time.Now().UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(e.opts.Path, rotated); err != nil {
+		e.opts.OnError(err)
+	} else if e.opts.Compress {
+		if err := gzipFile(rotated); err != nil {
+			e.opts.OnError(err)
+		}
+	}
+	if e.opts.MaxBackups > 0 {
+		if err := removeBackups(e.opts.Path, e.opts.MaxBackups); err != nil {
+			e.opts.OnError(err)
+		}
+	}
+	if err := e.open(); err != nil {
+		e.opts.OnError(err)
+	}
+}
+
+// close writes the cycles reported since the last write and closes the file.
+// The views must not be reported anymore.
+func (e *fileExporter) close() {
+	e.once.Do(func() {
+		e.mu.Lock()
+		if e.cycle > 0 {
+			e.queue(e.aggMap.GetCursor())
+		}
+		e.mu.Unlock()
+		close(e.done)
+		e.wg.Wait()
+	})
+}
+
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		zw.Close()
+		dst.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// removeBackups removes the oldest rotated files of path but the last keep.
+// Other files of the directory are left alone, even when their name starts
+// with the name of path.
+func removeBackups(path string, keep int) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, info := range infos {
+		if !info.IsDir() && isBackup(base, info.Name()) {
+			backups = append(backups, info.Name())
+		}
+	}
+	// rotated names sort by time
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// isBackup reports whether name is a file rotated from base: base followed by
+// a dot, the rotation time and, when compressed, .gz.
+func isBackup(base, name string) bool {
+	if !strings.HasPrefix(name, base+".") {
+		return false
+	}
+	_, err := time.Parse(rotatedTimeFormat, strings.TrimSuffix(name[len(base)+1:], ".gz"))
+	return err == nil
+}
+
+// csvHeader is the JSON names of the ChannelSummary fields, in order.
+var csvHeader = func() []string {
+	t := reflect.TypeOf(ChannelSummary{})
+	header := make([]string, t.NumField())
+	for i := range header {
+		header[i] = strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+	}
+	return header
+}()
+
+// csvValues returns the fields of cs in the order of csvHeader. Labels are
+// written as name=value pairs separated by semicolons.
+func csvValues(cs *ChannelSummary) []string {
+	v := reflect.ValueOf(cs).Elem()
+	values := make([]string, v.NumField())
+	for i := range values {
+		switch f := v.Field(i).Interface().(type) {
+		case string:
+			values[i] = f
+		case float64:
+			values[i] = strconv.FormatFloat(f, 'f', -1, 64)
+		case int64:
+			values[i] = strconv.FormatInt(f, 10)
+		case time.Time:
+			values[i] = f.Format(time.RFC3339Nano)
+		case map[string]string:
+			labels := make([]string, 0, len(f))
+			for name, value := range f {
+				labels = append(labels, name+"="+value)
+			}
+			sort.Strings(labels)
+			values[i] = strings.Join(labels, ";")
+		}
+	}
+	return values
+}
+
+func csvLine(record []string) []byte {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write(record)
+	w.Flush()
+	return []byte(b.String())
+}
@@ -0,0 +1,178 @@
+package stats
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileExporter_JSONRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.jsonl")
+
+	_, err = Init(WithExportInterval(10*time.Millisecond), WithFileExporter(FileOptions{Path: path}))
+	require.Error(t, err)
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter(), WithFileExporter(FileOptions{
+		Path:       path,
+		Interval:   20 * time.Millisecond,
+		MaxSize:    1,
+		Compress:   true,
+		MaxBackups: 2,
+	}))
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+
+	key := GetKey("node_file", "client_file", "some_channel", "", "publish", "")
+	for i := 0; i < 4; i++ {
+		require.NoError(t, key.Record(Item{MsgCount: 1, MsgSize: 10}))
+		time.Sleep(60 * time.Millisecond)
+	}
+	require.NoError(t, s.Close(context.Background()))
+
+	rotated, err := filepath.Glob(path + ".*.gz")
+	require.NoError(t, err)
+	require.Len(t, rotated, 2)
+	f, err := os.Open(rotated[1])
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	found := false
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		var record struct {
+			Time time.Time `json:"time"`
+			ChannelSummary
+		}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		assert.False(t, record.Time.IsZero())
+		if record.ClientID == "client_file" {
+			found = true
+			assert.EqualValues(t, 1, record.TotalMsgCount)
+			assert.EqualValues(t, 10, record.TotalMsgSize)
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestFileExporter_CSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.csv")
+
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter(), WithFileExporter(FileOptions{
+		Path:     path,
+		Format:   FileFormatCSV,
+		Interval: time.Hour,
+	}))
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+	key := GetKey("node_csv", "client_csv", "some,channel", "", "publish", "")
+	require.NoError(t, key.Record(Item{MsgCount: 2, MsgSize: 30}))
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, s.Close(context.Background()))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	require.NoError(t, err)
+	require.True(t, len(records) >= 2)
+	header := records[0]
+	assert.Equal(t, []string{"time", "node", "channel", "group", "client_id", "kind", "labels", "total_msg_count"}, header[:8])
+	found := false
+	for _, record := range records[1:] {
+		require.Len(t, record, len(header))
+		if record[4] == "client_csv" {
+			found = true
+			assert.Equal(t, "some,channel", record[2])
+			assert.Equal(t, "2", record[7])
+			assert.Equal(t, "15", record[9])
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestFileExporter_WholeCycles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.jsonl")
+
+	// the views are reported by the test, every second cycle is written
+	s, err := New(WithExportInterval(time.Hour), WithInternalExporter(), WithFileExporter(FileOptions{
+		Path:     path,
+		Interval: 2 * time.Hour,
+	}))
+	require.NoError(t, err)
+	key := GetKey("node_cycles", "client_cycles", "some_channel", "", "publish", "")
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.Record(key, Item{MsgCount: 1, MsgSize: 10}))
+		if i < 2 {
+			s.report()
+		}
+	}
+	// Close reports the third cycle and writes it
+	require.NoError(t, s.Close(context.Background()))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var counts, sizes []float64
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		var record fileRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		counts = append(counts, record.TotalMsgCount)
+		sizes = append(sizes, record.TotalMsgSize)
+	}
+	assert.Equal(t, []float64{2, 1}, counts)
+	assert.Equal(t, []float64{20, 10}, sizes)
+}
+
+func TestFileExporter_RemoveBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.jsonl")
+
+	names := []string{
+		"stats.jsonl",
+		"stats.jsonl.20200101T000000.000000000.gz",
+		"stats.jsonl.20200102T000000.000000000",
+		"stats.jsonl.20200103T000000.000000000.gz",
+		"stats.jsonl.bak",
+		"stats.jsonl.lock",
+		"stats.jsonl.20200101T000000.000000000.txt",
+	}
+	for _, name := range names {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+	require.NoError(t, removeBackups(path, 1))
+
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var left []string
+	for _, info := range infos {
+		left = append(left, info.Name())
+	}
+	assert.Equal(t, []string{
+		"stats.jsonl",
+		"stats.jsonl.20200101T000000.000000000.txt",
+		"stats.jsonl.20200103T000000.000000000.gz",
+		"stats.jsonl.bak",
+		"stats.jsonl.lock",
+	}, left)
+}
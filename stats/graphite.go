@@ -0,0 +1,272 @@
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats/view"
+)
+
+const (
+	defaultGraphiteAddress  = "127.0.0.1:2003"
+	defaultGraphiteTemplate = "{namespace}.{node}.{kind}.{channel}.{stat}"
+	defaultGraphiteTimeout  = 5 * time.Second
+	graphiteQueueSize       = 64
+)
+
+// GraphiteOptions configures the Graphite exporter enabled with WithGraphite.
+type GraphiteOptions struct {
+	// Address of the carbon plaintext listener, 127.0.0.1:2003 by default.
+	Address string
+	// Namespace is the value of the {namespace} field of the template.
+	Namespace string
+	// Template builds the path of a metric from the {namespace} and {stat}
+	// fields, the key fields such as {node}, {client_id} or {channel}, and the
+	// tag keys declared with WithTagKeys. Values are sanitized to letters,
+	// digits, '_' and '-', and empty path segments are dropped. The default is
+	// {namespace}.{node}.{kind}.{channel}.{stat}. The keys a template renders
+	// to the same path, such as the clients of a channel with the default,
+	// are sent as one metric: their counts and sums are added, their
+	// distributions merged and the latest of their last update times kept.
+	Template string
+	// Timeout bounds connecting and writing, 5 seconds by default.
+	Timeout time.Duration
+	// OnError is called when sending fails or a batch is dropped because too
+	// many are pending, the error is logged by default.
+	OnError func(err error)
+}
+
+var graphiteField = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// graphiteExporter sends the rows of the views in the carbon plaintext
+// protocol over TCP. Counts and sums are sent as their cumulative value and
+// distributions as count, sum, mean, min, max and percentile metrics. The
+// lines are sent by a background goroutine so an unreachable host never
+// blocks the export; a broken connection is dialed again and the write
+// retried once.
+type graphiteExporter struct {
+	opts     GraphiteOptions
+	declared tagKeySet
+	queue    chan []byte
+	done     chan struct{}
+	once     sync.Once
+	wg       sync.WaitGroup
+	// conn is only used by the sending goroutine.
+	conn net.Conn
+}
+
+func newGraphiteExporter(opts GraphiteOptions, declared tagKeySet) (*graphiteExporter, error) {
+	if opts.Address == "" {
+		opts.Address = defaultGraphiteAddress
+	}
+	if opts.Template == "" {
+		opts.Template = defaultGraphiteTemplate
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultGraphiteTimeout
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(err error) {
+			log.Printf("Failed to export to Graphite: %v", err)
+		}
+	}
+	for _, m := range graphiteField.FindAllStringSubmatch(opts.Template, -1) {
+		switch name := m[1]; name {
+		case "namespace", "stat":
+		default:
+			if _, ok := declared.dimension(name); !ok {
+				return nil, fmt.Errorf("stats: unknown graphite template field %q", name)
+			}
+		}
+	}
+	e := &graphiteExporter{
+		opts:     opts,
+		declared: declared,
+		queue:    make(chan []byte, graphiteQueueSize),
+		done:     make(chan struct{}),
+	}
+	e.wg.Add(1)
+	go e.run()
+	return e, nil
+}
+
+func (e *graphiteExporter) ExportView(vd *view.Data) {
+	st, ok := statTypeOf(vd.View.Name)
+	if !ok || len(vd.Rows) == 0 {
+		return
+	}
+	select {
+	case <-e.done:
+		return
+	default:
+	}
+	// the rows the template renders to the same path are merged, carbon
+	// would only keep the last of them
+	type metric struct {
+		path  string
+		value float64
+		h     *histogram
+	}
+	var metrics []*metric
+	byPath := make(map[string]*metric)
+	for _, row := range vd.Rows {
+		path := e.path(makeKeyFromTags(row.Tags), st)
+		m, ok := byPath[path]
+		if !ok {
+			m = &metric{path: path}
+			byPath[path] = m
+			metrics = append(metrics, m)
+		}
+		switch v := row.Data.(type) {
+		case *view.CountData:
+			m.value += float64(v.Value)
+		case *view.SumData:
+			m.value += v.Value
+		case *view.LastValueData:
+			m.value = math.Max(m.value, v.Value)
+		case *view.DistributionData:
+			h := newHistogram(vd.View.Aggregation.Buckets, v)
+			if m.h == nil {
+				m.h = h
+			} else {
+				m.h = m.h.merge(h)
+			}
+		}
+	}
+	timestamp := strconv.FormatInt(vd.End.Unix(), 10)
+	var b bytes.Buffer
+	for _, m := range metrics {
+		h, path := m.h, m.path
+		if h == nil {
+			writeGraphite(&b, path, m.value, timestamp)
+			continue
+		}
+		writeGraphite(&b, path+".count", float64(h.count), timestamp)
+		writeGraphite(&b, path+".sum", h.sum, timestamp)
+		writeGraphite(&b, path+".mean", h.mean(), timestamp)
+		writeGraphite(&b, path+".min", h.min, timestamp)
+		writeGraphite(&b, path+".max", h.max, timestamp)
+		writeGraphite(&b, path+".p50", h.percentile(50), timestamp)
+		writeGraphite(&b, path+".p90", h.percentile(90), timestamp)
+		writeGraphite(&b, path+".p99", h.percentile(99), timestamp)
+	}
+	select {
+	case e.queue <- b.Bytes():
+	default:
+		e.opts.OnError(fmt.Errorf("stats: dropped Graphite export of %s, too many pending batches", vd.View.Name))
+	}
+}
+
+// path renders the template for the key and stat.
+func (e *graphiteExporter) path(key Key, st statType) string {
+	path := graphiteField.ReplaceAllStringFunc(e.opts.Template, func(field string) string {
+		switch name := field[1 : len(field)-1]; name {
+		case "namespace":
+			return sanitizeGraphite(e.opts.Namespace)
+		case "stat":
+			return sanitizeGraphite(st.String())
+		default:
+			d, _ := e.declared.dimension(name)
+			return sanitizeGraphite(key.value(d))
+		}
+	})
+	segments := strings.Split(path, ".")
+	n := 0
+	for _, s := range segments {
+		if s != "" {
+			segments[n] = s
+			n++
+		}
+	}
+	return strings.Join(segments[:n], ".")
+}
+
+func (e *graphiteExporter) run() {
+	defer e.wg.Done()
+	for {
+		select {
+		case lines := <-e.queue:
+			e.write(lines)
+		case <-e.done:
+			for {
+				select {
+				case lines := <-e.queue:
+					e.write(lines)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *graphiteExporter) write(lines []byte) {
+	if err := e.send(lines); err != nil {
+		e.opts.OnError(err)
+	}
+}
+
+// send writes the lines, dialing again and retrying once when the connection
+// is broken.
+func (e *graphiteExporter) send(lines []byte) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if e.conn == nil {
+			e.conn, err = net.DialTimeout("tcp", e.opts.Address, e.opts.Timeout)
+			if err != nil {
+				e.conn = nil
+				return err
+			}
+		}
+		e.conn.SetWriteDeadline(time.Now().Add(e.opts.Timeout))
+		if _, err = e.conn.Write(lines); err == nil {
+			return nil
+		}
+		e.conn.Close()
+		e.conn = nil
+	}
+	return err
+}
+
+// close sends the pending lines and stops the exporter.
+func (e *graphiteExporter) close() error {
+	var err error
+	e.once.Do(func() {
+		close(e.done)
+		e.wg.Wait()
+		if e.conn != nil {
+			err = e.conn.Close()
+			e.conn = nil
+		}
+	})
+	return err
+}
+
+func writeGraphite(b *bytes.Buffer, path string, value float64, timestamp string) {
+	b.WriteString(path)
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	b.WriteByte(' ')
+	b.WriteString(timestamp)
+	b.WriteByte('\n')
+}
+
+// sanitizeGraphite replaces the characters other than letters, digits, '_'
+// and '-' with underscores.
+func sanitizeGraphite(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
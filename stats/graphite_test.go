@@ -0,0 +1,181 @@
+package stats
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestGraphite_Path(t *testing.T) {
+	e, err := newGraphiteExporter(GraphiteOptions{Namespace: "kubemq"}, nil)
+	require.NoError(t, err)
+	key := GetKey("node.1", "client_1", "some_channel_*,|,>%$#*Q1", "", "publish", "")
+	assert.Equal(t, "kubemq.node_1.publish.some_channel__________Q1.total_messages", e.path(key, typeMsgCount))
+
+	e, err = newGraphiteExporter(GraphiteOptions{Template: "{namespace}.{client_id}.{group}.{stat}"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "client_1.total_errors", e.path(key, typeErrors))
+
+	_, err = newGraphiteExporter(GraphiteOptions{Template: "{namespace}.{unknown}.{stat}"}, nil)
+	assert.Error(t, err)
+}
+
+func TestGraphite_Reconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	lines := make(chan string, 100)
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go func() {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+
+	e, err := newGraphiteExporter(GraphiteOptions{Address: l.Addr().String(), Namespace: "kubemq"}, nil)
+	require.NoError(t, err)
+	defer e.close()
+	vd := &view.Data{
+		View: &view.View{Name: typeErrors.String(), TagKeys: Keys, Aggregation: view.Count()},
+		End:  time.Unix(1500000000, 0),
+		Rows: []*view.Row{{
+			Tags: []tag.Tag{{Key: KeyNode, Value: "node_1"}, {Key: KeyKind, Value: "publish"}, {Key: KeyChannel, Value: "channel_1"}},
+			Data: &view.CountData{Value: 3},
+		}},
+	}
+	e.ExportView(vd)
+	assert.Equal(t, "kubemq.node_1.publish.channel_1.total_errors 3 1500000000", <-lines)
+
+	// the server drops the connection, the exporter dials again
+	(<-conns).Close()
+	vd.Rows[0].Data = &view.CountData{Value: 5}
+	deadline := time.After(2 * time.Second)
+	for {
+		e.ExportView(vd)
+		select {
+		case line := <-lines:
+			assert.Equal(t, "kubemq.node_1.publish.channel_1.total_errors 5 1500000000", line)
+			return
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("no line received after the connection was dropped")
+		}
+	}
+}
+
+func TestGraphite_MergeRows(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	e, err := newGraphiteExporter(GraphiteOptions{Address: l.Addr().String(), Namespace: "kubemq"}, nil)
+	require.NoError(t, err)
+	defer e.close()
+
+	// the default template has no client_id, the clients of the channel are
+	// sent as one metric
+	tags := func(clientID string) []tag.Tag {
+		return []tag.Tag{{Key: KeyNode, Value: "node_1"}, {Key: KeyClientID, Value: clientID}, {Key: KeyKind, Value: "publish"}, {Key: KeyChannel, Value: "channel_1"}}
+	}
+	e.ExportView(&view.Data{
+		View: &view.View{Name: typeErrors.String(), TagKeys: Keys, Aggregation: view.Count()},
+		End:  time.Unix(1500000000, 0),
+		Rows: []*view.Row{
+			{Tags: tags("client_1"), Data: &view.CountData{Value: 3}},
+			{Tags: tags("client_2"), Data: &view.CountData{Value: 2}},
+		},
+	})
+	buckets := []float64{10, 100}
+	e.ExportView(&view.Data{
+		View: &view.View{Name: typeLatency.String(), TagKeys: Keys, Aggregation: view.Distribution(buckets...)},
+		End:  time.Unix(1500000000, 0),
+		Rows: []*view.Row{
+			{Tags: tags("client_1"), Data: &view.DistributionData{Count: 1, Min: 5, Max: 5, Mean: 5, CountPerBucket: []int64{1, 0, 0}}},
+			{Tags: tags("client_2"), Data: &view.DistributionData{Count: 2, Min: 50, Max: 70, Mean: 60, CountPerBucket: []int64{0, 2, 0}}},
+		},
+	})
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	lines := map[string]string{}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() && len(lines) < 9 {
+		fields := strings.Fields(scanner.Text())
+		_, dup := lines[fields[0]]
+		assert.False(t, dup, "path %s sent twice", fields[0])
+		lines[fields[0]] = fields[1]
+	}
+	assert.Equal(t, "5", lines["kubemq.node_1.publish.channel_1.total_errors"])
+	assert.Equal(t, "3", lines["kubemq.node_1.publish.channel_1.total_latency.count"])
+	assert.Equal(t, "125", lines["kubemq.node_1.publish.channel_1.total_latency.sum"])
+	assert.Equal(t, "5", lines["kubemq.node_1.publish.channel_1.total_latency.min"])
+	assert.Equal(t, "70", lines["kubemq.node_1.publish.channel_1.total_latency.max"])
+}
+
+func TestGraphite_Distribution(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithGraphite(GraphiteOptions{
+		Address:   l.Addr().String(),
+		Namespace: "kubemq",
+		Template:  "{namespace}.{client_id}.{stat}",
+	}))
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+
+	key := GetKey("node_graphite", "client_graphite", "some_channel", "", "publish", "")
+	require.NoError(t, key.Record(Item{MsgCount: 1, Latency: 10 * time.Millisecond}))
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() && len(seen) < 2 {
+		switch path := strings.Fields(scanner.Text())[0]; path {
+		case "kubemq.client_graphite.total_latency.max", "kubemq.client_graphite.total_messages":
+			seen[path] = true
+		}
+	}
+	assert.Len(t, seen, 2)
+}
+
+func TestGraphite_UnreachableDoesNotBlock(t *testing.T) {
+	e, err := newGraphiteExporter(GraphiteOptions{
+		Address: "10.255.255.1:2003",
+		Timeout: 200 * time.Millisecond,
+		OnError: func(err error) {},
+	}, nil)
+	require.NoError(t, err)
+	vd := &view.Data{
+		View: &view.View{Name: typeErrors.String(), TagKeys: Keys, Aggregation: view.Count()},
+		End:  time.Unix(1500000000, 0),
+		Rows: []*view.Row{{Tags: []tag.Tag{{Key: KeyNode, Value: "node_1"}}, Data: &view.CountData{Value: 3}}},
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		e.ExportView(vd)
+	}
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+	e.close()
+}
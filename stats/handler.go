@@ -0,0 +1,242 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opencensus.io/tag"
+)
+
+// MetricsResponse is the body served by the handler of GetJSONHandler.
+type MetricsResponse struct {
+	Summary Summary `json:"summary"`
+	// Total is the number of channel summaries matching the filters, before
+	// pagination.
+	Total    int               `json:"total"`
+	Channels []*ChannelSummary `json:"channels"`
+}
+
+// GetJSONHandler returns a handler serving the internal exporter summaries as
+// a MetricsResponse. It accepts the following query parameters:
+//
+//	window    a window configured with WithWindows, cumulative values if unset
+//	group_by  comma separated dimensions to roll the summaries up by
+//	sort      the JSON name of a ChannelSummary field, the key by default
+//	order     asc (default) or desc
+//	limit     maximum number of channel summaries, all of them if unset
+//	offset    number of channel summaries to skip
+//
+// Any other parameter names a key field, such as node, channel, client_id or
+// kind, or a tag key declared with WithTagKeys, and keeps the keys having one
+// of the given values. The summary covers every matching key.
+func (s *Stats) GetJSONHandler() http.Handler {
+	return &jsonHandler{stats: s}
+}
+
+type jsonHandler struct {
+	stats *Stats
+}
+
+type jsonRequest struct {
+	window time.Duration
+	query  query
+	sort   string
+	desc   bool
+	limit  int
+	offset int
+}
+
+func (h *jsonHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.stats.internalExporter == nil {
+		http.Error(w, "stats: internal exporter is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	req, err := parseJSONRequest(r, h.stats.declared)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, sum, err := h.stats.query(req.window, req.query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := MetricsResponse{
+		Summary:  sum,
+		Total:    len(m),
+		Channels: sortChannelSummaries(m, req.sort, req.desc),
+	}
+	if req.offset >= len(resp.Channels) {
+		resp.Channels = resp.Channels[:0]
+	} else {
+		resp.Channels = resp.Channels[req.offset:]
+	}
+	if req.limit > 0 && req.limit < len(resp.Channels) {
+		resp.Channels = resp.Channels[:req.limit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func parseJSONRequest(r *http.Request, declared tagKeySet) (*jsonRequest, error) {
+	req := &jsonRequest{}
+	filters := make(map[tag.Key]map[string]bool)
+	var err error
+	for name, values := range r.URL.Query() {
+		value := values[len(values)-1]
+		switch name {
+		case "window":
+			if value != "" {
+				if req.window, err = time.ParseDuration(value); err != nil || req.window < 0 {
+					return nil, fmt.Errorf("stats: invalid window %q", value)
+				}
+			}
+		case "group_by":
+			req.query.dims = []tag.Key{}
+			for _, name := range strings.Split(value, ",") {
+				if name == "" {
+					continue
+				}
+				d, ok := declared.dimension(name)
+				if !ok {
+					return nil, fmt.Errorf("stats: unknown dimension %q", name)
+				}
+				req.query.dims = append(req.query.dims, d)
+			}
+		case "sort":
+			if _, ok := sortFields[value]; !ok && value != "" {
+				return nil, fmt.Errorf("stats: invalid sort field %q", value)
+			}
+			req.sort = value
+		case "order":
+			switch value {
+			case "", "asc":
+			case "desc":
+				req.desc = true
+			default:
+				return nil, fmt.Errorf("stats: invalid order %q", value)
+			}
+		case "limit":
+			if req.limit, err = strconv.Atoi(value); err != nil || req.limit < 0 {
+				return nil, fmt.Errorf("stats: invalid limit %q", value)
+			}
+		case "offset":
+			if req.offset, err = strconv.Atoi(value); err != nil || req.offset < 0 {
+				return nil, fmt.Errorf("stats: invalid offset %q", value)
+			}
+		default:
+			if err := addFilter(declared, filters, name, values); err != nil {
+				return nil, err
+			}
+		}
+	}
+	req.query.match = filterMatch(filters)
+	return req, nil
+}
+
+// addFilter adds the values of the dimension named name, a key field or one
+// of declared, to filters.
+func addFilter(declared tagKeySet, filters map[tag.Key]map[string]bool, name string, values []string) error {
+	d, ok := declared.dimension(name)
+	if !ok {
+		return fmt.Errorf("stats: unknown parameter %q", name)
+	}
+	filters[d] = make(map[string]bool, len(values))
+	for _, v := range values {
+		filters[d][v] = true
+	}
+	return nil
+}
+
+// filterMatch returns a function keeping the keys having one of the values of
+// every dimension of filters, nil when there are none.
+func filterMatch(filters map[tag.Key]map[string]bool) func(Key) bool {
+	if len(filters) == 0 {
+		return nil
+	}
+	return func(k Key) bool {
+		for d, values := range filters {
+			if !values[k.value(d)] {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// sortFields maps the JSON names of the scalar ChannelSummary fields to their
+// index.
+var sortFields = func() map[string]int {
+	fields := make(map[string]int)
+	t := reflect.TypeOf(ChannelSummary{})
+	for i := 0; i < t.NumField(); i++ {
+		switch t.Field(i).Type.Kind() {
+		case reflect.String, reflect.Float64, reflect.Int64:
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			fields[name] = i
+		}
+	}
+	return fields
+}()
+
+// sortChannelSummaries returns the summaries of m ordered by the field named
+// field, then by key.
+func sortChannelSummaries(m map[string]*ChannelSummary, field string, desc bool) []*ChannelSummary {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	index, byField := sortFields[field]
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if desc {
+			a, b = b, a
+		}
+		if byField {
+			if c := compareField(m[a], m[b], index); c != 0 {
+				return c < 0
+			}
+		}
+		return a < b
+	})
+	list := make([]*ChannelSummary, len(keys))
+	for i, key := range keys {
+		list[i] = m[key]
+	}
+	return list
+}
+
+func compareField(a, b *ChannelSummary, index int) int {
+	va := reflect.ValueOf(a).Elem().Field(index)
+	vb := reflect.ValueOf(b).Elem().Field(index)
+	switch va.Kind() {
+	case reflect.String:
+		return strings.Compare(va.String(), vb.String())
+	case reflect.Float64:
+		switch {
+		case va.Float() < vb.Float():
+			return -1
+		case va.Float() > vb.Float():
+			return 1
+		}
+	case reflect.Int64:
+		switch {
+		case va.Int() < vb.Int():
+			return -1
+		case va.Int() > vb.Int():
+			return 1
+		}
+	}
+	return 0
+}
@@ -54,9 +54,17 @@ func ReportMessageSubscribe(keys map[Key]struct{}, msgCount, msgSize float64) {
 		MsgSize:    msgSize,
 		LastUpdate: time.Now().UTC().UnixNano(),
 	}
+	s := Default()
+	if s == nil || !s.addRecording() {
+		return
+	}
 	go func() {
+		defer s.recordings.Done()
+		// recorded even when Close started meanwhile, since Close waits for it
+		s.recordMu.RLock()
+		defer s.recordMu.RUnlock()
 		for key, _ := range keys {
-			key.Record(item)
+			s.recordKey(key, []Item{item})
 		}
 	}()
 
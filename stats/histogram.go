@@ -0,0 +1,165 @@
+package stats
+
+import (
+	"math"
+
+	"go.opencensus.io/stats/view"
+)
+
+// histogram is a bucketed distribution as reported by a view.Distribution
+// aggregation. Bucket i holds the values in [bounds[i-1], bounds[i]), the first
+// bucket is open below and the last one is open above.
+type histogram struct {
+	bounds []float64
+	counts []int64
+	count  int64
+	sum    float64
+	min    float64
+	max    float64
+}
+
+func newHistogram(bounds []float64, data *view.DistributionData) *histogram {
+	h := &histogram{
+		bounds: bounds,
+		counts: make([]int64, len(data.CountPerBucket)),
+		count:  data.Count,
+		sum:    data.Sum(),
+		min:    data.Min,
+		max:    data.Max,
+	}
+	copy(h.counts, data.CountPerBucket)
+	return h
+}
+
+func (h *histogram) isEmpty() bool {
+	return h == nil || h.count == 0
+}
+
+func (h *histogram) sameBounds(o *histogram) bool {
+	if len(h.bounds) != len(o.bounds) || len(h.counts) != len(o.counts) {
+		return false
+	}
+	for i := range h.bounds {
+		if h.bounds[i] != o.bounds[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sub returns the distribution of the values added to h since prev. Min and
+// max of the interval are estimated from the edges of the outermost non-empty
+// buckets, clamped to the cumulative min and max.
+func (h *histogram) sub(prev *histogram) *histogram {
+	if h.isEmpty() {
+		return nil
+	}
+	if prev.isEmpty() || !h.sameBounds(prev) || h.count < prev.count {
+		return h.clone()
+	}
+	d := &histogram{
+		bounds: h.bounds,
+		counts: make([]int64, len(h.counts)),
+		count:  h.count - prev.count,
+		sum:    h.sum - prev.sum,
+	}
+	if d.count == 0 {
+		return nil
+	}
+	first, last := -1, -1
+	for i := range h.counts {
+		d.counts[i] = h.counts[i] - prev.counts[i]
+		if d.counts[i] > 0 {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	d.min, d.max = h.min, h.max
+	if first >= 0 {
+		d.min = math.Max(h.lower(first), h.min)
+		d.max = math.Min(h.upper(last), h.max)
+	}
+	return d
+}
+
+// merge returns the union of h and o. Bucket counts are only combined when
+// both sides share the same bounds.
+func (h *histogram) merge(o *histogram) *histogram {
+	if o.isEmpty() {
+		return h
+	}
+	if h.isEmpty() {
+		return o.clone()
+	}
+	m := h.clone()
+	m.count += o.count
+	m.sum += o.sum
+	m.min = math.Min(m.min, o.min)
+	m.max = math.Max(m.max, o.max)
+	if m.sameBounds(o) {
+		for i := range o.counts {
+			m.counts[i] += o.counts[i]
+		}
+	} else {
+		m.counts = nil
+	}
+	return m
+}
+
+func (h *histogram) clone() *histogram {
+	c := *h
+	c.counts = make([]int64, len(h.counts))
+	copy(c.counts, h.counts)
+	return &c
+}
+
+func (h *histogram) lower(i int) float64 {
+	if i == 0 {
+		return h.min
+	}
+	return h.bounds[i-1]
+}
+
+func (h *histogram) upper(i int) float64 {
+	if i >= len(h.bounds) {
+		return h.max
+	}
+	return h.bounds[i]
+}
+
+func (h *histogram) mean() float64 {
+	if h.isEmpty() {
+		return 0
+	}
+	return h.sum / float64(h.count)
+}
+
+// percentile estimates the p-th percentile (0 < p <= 100) by linear
+// interpolation inside the bucket holding the rank.
+func (h *histogram) percentile(p float64) float64 {
+	if h.isEmpty() {
+		return 0
+	}
+	if len(h.counts) == 0 {
+		return h.mean()
+	}
+	rank := p / 100 * float64(h.count)
+	var seen int64
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		if float64(seen+c) >= rank {
+			lo := math.Max(h.lower(i), h.min)
+			hi := math.Min(h.upper(i), h.max)
+			if hi <= lo {
+				return lo
+			}
+			return lo + (hi-lo)*(rank-float64(seen))/float64(c)
+		}
+		seen += c
+	}
+	return h.max
+}
@@ -0,0 +1,333 @@
+package stats
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opencensus.io/stats/view"
+)
+
+const (
+	defaultInfluxBatchSize     = 1000
+	defaultInfluxMaxBuffered   = 10000
+	defaultInfluxFlushInterval = time.Second
+	defaultInfluxMaxRetries    = 3
+	defaultInfluxRetryBackoff  = 100 * time.Millisecond
+)
+
+// InfluxOptions configures the InfluxDB exporter enabled with WithInflux.
+// Exactly one of URL and File must be set.
+type InfluxOptions struct {
+	// URL is the write endpoint, such as http://localhost:8086/write?db=stats.
+	URL string
+	// Header is added to every write request, for instance to authenticate.
+	Header http.Header
+	// Client sends the write requests, http.DefaultClient by default.
+	Client *http.Client
+	// File is the path of a file the lines are appended to.
+	File string
+	// BatchSize is the maximum number of lines per write, 1000 by default.
+	BatchSize int
+	// MaxBuffered bounds the lines waiting to be written, 10000 by default.
+	// The lines exported while the buffer is full are dropped.
+	MaxBuffered int
+	// FlushInterval is the longest a line waits for its batch to fill, one
+	// second by default.
+	FlushInterval time.Duration
+	// MaxRetries is the number of times a failed write is retried before its
+	// batch is dropped, 3 by default and none when negative.
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry, doubled on every
+	// following one, 100ms by default.
+	RetryBackoff time.Duration
+	// OnError is called when a batch is dropped, the error is logged by
+	// default.
+	OnError func(err error)
+}
+
+// InfluxCounters are the counters of the InfluxDB exporter.
+type InfluxCounters struct {
+	// Written is the number of lines written.
+	Written uint64
+	// Retries is the number of writes retried.
+	Retries uint64
+	// DroppedOverflow is the number of lines dropped because the buffer was
+	// full.
+	DroppedOverflow uint64
+	// DroppedFailed is the number of lines dropped because their write still
+	// failed after the last retry.
+	DroppedFailed uint64
+}
+
+// influxExporter writes the rows of the views as InfluxDB line protocol, a
+// measurement per view with the key fields and labels as tags. Lines are
+// buffered and written in batches by a background goroutine.
+type influxExporter struct {
+	opts  InfluxOptions
+	write func(batch []byte) (retry bool, err error)
+	file  *os.File
+
+	mu    sync.Mutex
+	lines [][]byte
+
+	kick      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	written, retries, overflow, failed uint64
+}
+
+func newInfluxExporter(opts InfluxOptions) (*influxExporter, error) {
+	if (opts.URL == "") == (opts.File == "") {
+		return nil, errors.New("stats: influx exporter needs either a URL or a file")
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultInfluxBatchSize
+	}
+	if opts.MaxBuffered <= 0 {
+		opts.MaxBuffered = defaultInfluxMaxBuffered
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultInfluxFlushInterval
+	}
+	if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	} else if opts.MaxRetries == 0 {
+		opts.MaxRetries = defaultInfluxMaxRetries
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = defaultInfluxRetryBackoff
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(err error) {
+			log.Printf("Failed to export to InfluxDB: %v", err)
+		}
+	}
+	e := &influxExporter{
+		opts: opts,
+		kick: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	if opts.File != "" {
+		f, err := os.OpenFile(opts.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		e.file = f
+		e.write = e.writeFile
+	} else {
+		e.write = e.post
+	}
+	e.wg.Add(1)
+	go e.run()
+	return e, nil
+}
+
+func (e *influxExporter) ExportView(vd *view.Data) {
+	if _, ok := statTypeOf(vd.View.Name); !ok {
+		return
+	}
+	measurement := escapeInflux(vd.View.Name, ", ")
+	timestamp := strconv.FormatInt(vd.End.UnixNano(), 10)
+	e.mu.Lock()
+	for _, row := range vd.Rows {
+		if len(e.lines) >= e.opts.MaxBuffered {
+			e.overflow++
+			continue
+		}
+		e.lines = append(e.lines, influxLine(measurement, vd.View.Aggregation.Buckets, row, timestamp))
+	}
+	full := len(e.lines) >= e.opts.BatchSize
+	e.mu.Unlock()
+	if full {
+		select {
+		case e.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func influxLine(measurement string, bounds []float64, row *view.Row, timestamp string) []byte {
+	var b bytes.Buffer
+	b.WriteString(measurement)
+	tags := make([]string, 0, len(row.Tags))
+	for _, t := range row.Tags {
+		if t.Value != "" {
+			tags = append(tags, escapeInflux(t.Key.Name(), ",= ")+"="+escapeInflux(t.Value, ",= "))
+		}
+	}
+	sort.Strings(tags)
+	for _, t := range tags {
+		b.WriteByte(',')
+		b.WriteString(t)
+	}
+	b.WriteByte(' ')
+	switch v := row.Data.(type) {
+	case *view.CountData:
+		fmt.Fprintf(&b, "count=%di", v.Value)
+	case *view.SumData:
+		b.WriteString("sum=")
+		b.WriteString(formatInflux(v.Value))
+	case *view.LastValueData:
+		b.WriteString("last=")
+		b.WriteString(formatInflux(v.Value))
+	case *view.DistributionData:
+		fmt.Fprintf(&b, "count=%di,sum=%s,mean=%s,min=%s,max=%s", v.Count,
+			formatInflux(v.Sum()), formatInflux(v.Mean), formatInflux(v.Min), formatInflux(v.Max))
+		// buckets are cumulative, as Prometheus le buckets
+		var cumulative int64
+		for i, c := range v.CountPerBucket {
+			cumulative += c
+			bound := "inf"
+			if i < len(bounds) {
+				bound = formatInflux(bounds[i])
+			}
+			fmt.Fprintf(&b, ",le_%s=%di", bound, cumulative)
+		}
+	}
+	b.WriteByte(' ')
+	b.WriteString(timestamp)
+	return b.Bytes()
+}
+
+func (e *influxExporter) run() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(e.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			for e.flush() {
+			}
+			return
+		case <-ticker.C:
+			for e.flush() {
+			}
+		case <-e.kick:
+			for e.flush() {
+			}
+		}
+	}
+}
+
+// flush writes a batch of buffered lines and reports whether there are more.
+func (e *influxExporter) flush() bool {
+	e.mu.Lock()
+	n := len(e.lines)
+	if n > e.opts.BatchSize {
+		n = e.opts.BatchSize
+	}
+	batch := e.lines[:n:n]
+	e.lines = e.lines[n:]
+	more := len(e.lines) > 0
+	e.mu.Unlock()
+	if n == 0 {
+		return false
+	}
+	body := bytes.Join(batch, []byte{'\n'})
+	body = append(body, '\n')
+	backoff := e.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := e.write(body)
+		if err == nil {
+			atomic.AddUint64(&e.written, uint64(n))
+			return more
+		}
+		if !retry || attempt >= e.opts.MaxRetries {
+			atomic.AddUint64(&e.failed, uint64(n))
+			e.opts.OnError(fmt.Errorf("stats: dropped %d lines: %v", n, err))
+			return more
+		}
+		atomic.AddUint64(&e.retries, 1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends a batch to the write endpoint. Client errors other than 429 are
+// not retried.
+func (e *influxExporter) post(batch []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, e.opts.URL, bytes.NewReader(batch))
+	if err != nil {
+		return false, err
+	}
+	for name, values := range e.opts.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := e.opts.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = fmt.Errorf("influx write returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+func (e *influxExporter) writeFile(batch []byte) (bool, error) {
+	_, err := e.file.Write(batch)
+	return true, err
+}
+
+func (e *influxExporter) counters() InfluxCounters {
+	e.mu.Lock()
+	overflow := e.overflow
+	e.mu.Unlock()
+	return InfluxCounters{
+		Written:         atomic.LoadUint64(&e.written),
+		Retries:         atomic.LoadUint64(&e.retries),
+		DroppedOverflow: overflow,
+		DroppedFailed:   atomic.LoadUint64(&e.failed),
+	}
+}
+
+// close writes the buffered lines and stops the exporter.
+func (e *influxExporter) close() error {
+	var err error
+	e.closeOnce.Do(func() {
+		close(e.done)
+		e.wg.Wait()
+		if e.file != nil {
+			err = e.file.Close()
+		}
+	})
+	return err
+}
+
+// escapeInflux escapes the characters of special with a backslash.
+func escapeInflux(s, special string) string {
+	if !strings.ContainsAny(s, special) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func formatInflux(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
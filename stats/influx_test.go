@@ -0,0 +1,130 @@
+package stats
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func influxViewData(name string, agg *view.Aggregation, data ...view.AggregationData) *view.Data {
+	vd := &view.Data{
+		View: &view.View{Name: name, TagKeys: Keys, Aggregation: agg},
+		End:  time.Unix(1500000000, 0),
+	}
+	for i, d := range data {
+		vd.Rows = append(vd.Rows, &view.Row{
+			Tags: []tag.Tag{
+				{Key: KeyNode, Value: "node 1"},
+				{Key: KeyChannel, Value: "a,b=c"},
+				{Key: KeyClientID, Value: "client_" + string(rune('1'+i))},
+			},
+			Data: d,
+		})
+	}
+	return vd
+}
+
+func TestInflux_LineProtocol(t *testing.T) {
+	vd := influxViewData(typeLatency.String(), view.Distribution(10, 20),
+		&view.DistributionData{Count: 4, Min: 5, Max: 25, Mean: 15, CountPerBucket: []int64{1, 2, 1}})
+	line := influxLine(typeLatency.String(), vd.View.Aggregation.Buckets, vd.Rows[0], "1500000000000000000")
+	assert.Equal(t, `total_latency,channel=a\,b\=c,client_id=client_1,node=node\ 1 `+
+		`count=4i,sum=60,mean=15,min=5,max=25,le_10=1i,le_20=3i,le_inf=4i 1500000000000000000`, string(line))
+
+	vd = influxViewData(typeErrors.String(), view.Count(), &view.CountData{Value: 3})
+	line = influxLine(typeErrors.String(), nil, vd.Rows[0], "1")
+	assert.Equal(t, `total_errors,channel=a\,b\=c,client_id=client_1,node=node\ 1 count=3i 1`, string(line))
+}
+
+func TestInflux_HTTPRetries(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		assert.Equal(t, "token", r.Header.Get("Authorization"))
+		if requests%2 == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	e, err := newInfluxExporter(InfluxOptions{
+		URL:           server.URL + "/write?db=stats",
+		Header:        http.Header{"Authorization": {"token"}},
+		BatchSize:     2,
+		MaxBuffered:   3,
+		FlushInterval: time.Hour,
+		RetryBackoff:  time.Millisecond,
+	})
+	require.NoError(t, err)
+	e.ExportView(influxViewData(typeMsgCount.String(), view.Sum(),
+		&view.SumData{Value: 1}, &view.SumData{Value: 2}, &view.SumData{Value: 3}, &view.SumData{Value: 4}))
+	require.NoError(t, e.close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, bodies, 2)
+	assert.Equal(t, 2, strings.Count(bodies[0], "\n"))
+	assert.Contains(t, bodies[0], "sum=1 ")
+	assert.Contains(t, bodies[1], "sum=3 ")
+	assert.Equal(t, InfluxCounters{Written: 3, Retries: 2, DroppedOverflow: 1}, e.counters())
+}
+
+func TestInflux_DropFailed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad line", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	var dropped error
+	e, err := newInfluxExporter(InfluxOptions{
+		URL:     server.URL,
+		OnError: func(err error) { dropped = err },
+	})
+	require.NoError(t, err)
+	e.ExportView(influxViewData(typeMsgCount.String(), view.Sum(), &view.SumData{Value: 1}))
+	require.NoError(t, e.close())
+	assert.Error(t, dropped)
+	assert.Equal(t, InfluxCounters{DroppedFailed: 1}, e.counters())
+}
+
+func TestInflux_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.line")
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInflux(InfluxOptions{
+		File:          path,
+		FlushInterval: 10 * time.Millisecond,
+	}))
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+
+	key := GetKey("node_influx", "client_influx", "some_channel", "", "publish", "")
+	require.NoError(t, key.Record(Item{MsgCount: 2, MsgSize: 20}))
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, s.Close(context.Background()))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "total_messages,channel=some_channel,client_id=client_influx,kind=publish,node=node_influx sum=2 ")
+	assert.True(t, s.InfluxCounters().Written > 0)
+}
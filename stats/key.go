@@ -2,142 +2,361 @@ package stats
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"strings"
 
 	ocstats "go.opencensus.io/stats"
 	"go.opencensus.io/tag"
 )
 
-const separator = "<|>"
+const (
+	separator = "<|>"
+	escape    = '\\'
+	numFields = 6
+)
+
+// Key identifies the series a recording belongs to. Keys are comparable and
+// can be used as map keys.
+type Key struct {
+	node     string
+	clientID string
+	channel  string
+	group    string
+	kind     string
+	subKind  string
+	labels   string
+}
 
-type Key string
+func GetKey(node, clientID, channel, group, kind, subKind string, labels ...Label) Key {
+	return Key{
+		node:     node,
+		clientID: clientID,
+		channel:  channel,
+		group:    group,
+		kind:     kind,
+		subKind:  subKind,
+		labels:   encodeLabels(labels),
+	}
+}
 
-func GetKey(node, clientID, channel, group, kind, subKind string) Key {
-	fields := []string{node, clientID, channel, group, kind, subKind}
-	return Key(strings.Join(fields, separator))
+// ParseKey decodes a key from its String form and validates its fields.
+func ParseKey(s string) (Key, error) {
+	segments := splitEscaped(s, separator)
+	if len(segments) < numFields {
+		return Key{}, fmt.Errorf("stats: invalid key %q: expected at least %d fields, got %d", s, numFields, len(segments))
+	}
+	var fields [numFields]string
+	for i := range fields {
+		field, err := unescape(segments[i])
+		if err != nil {
+			return Key{}, fmt.Errorf("stats: invalid key %q: %v", s, err)
+		}
+		fields[i] = field
+	}
+	labels, err := decodeLabels(strings.Join(segments[numFields:], separator))
+	if err != nil {
+		return Key{}, fmt.Errorf("stats: invalid key %q: %v", s, err)
+	}
+	k := GetKey(fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], labels...)
+	if err := k.Validate(); err != nil {
+		return Key{}, err
+	}
+	return k, nil
 }
+
 func makeKeyFromTags(tags []tag.Tag) Key {
-	m := make(map[string]string, len(tags))
+	var k Key
+	var labels []Label
 	for _, t := range tags {
-		m[t.Key.Name()] = t.Value
+		switch t.Key {
+		case KeyNode:
+			k.node = t.Value
+		case KeyClientID:
+			k.clientID = t.Value
+		case KeyChannel:
+			k.channel = t.Value
+		case KeyGroup:
+			k.group = t.Value
+		case KeyKind:
+			k.kind = t.Value
+		case KeySubKind:
+			k.subKind = t.Value
+		default:
+			labels = append(labels, Label{Name: t.Key.Name(), Value: t.Value})
+		}
+	}
+	k.labels = encodeLabels(labels)
+	return k
+}
+
+var fieldKeys = [numFields]tag.Key{KeyNode, KeyClientID, KeyChannel, KeyGroup, KeyKind, KeySubKind}
+
+func (k Key) fields() [numFields]string {
+	return [numFields]string{k.node, k.clientID, k.channel, k.group, k.kind, k.subKind}
+}
+
+// Validate reports whether every field of the key is a valid tag value.
+func (k Key) Validate() error {
+	fields := k.fields()
+	for i, value := range fields {
+		if err := checkTagValue(value); err != nil {
+			return fmt.Errorf("stats: invalid %s %q: %v", fieldKeys[i].Name(), value, err)
+		}
 	}
-	fields := []string{
-		m["node"],
-		m["client_id"],
-		m["channel"],
-		m["group"],
-		m["kind"],
-		m["sub_kind"],
+	for _, l := range k.Labels() {
+		if err := checkTagValue(l.Value); err != nil {
+			return fmt.Errorf("stats: invalid %s %q: %v", l.Name, l.Value, err)
+		}
 	}
-	return Key(strings.Join(fields, separator))
+	return nil
 }
 
-func (k Key) getElement(n int) string {
-	fields := strings.Split(string(k), separator)
-	if n+1 > len(fields) {
-		return ""
+func checkTagValue(value string) error {
+	if len(value) > 255 {
+		return errors.New("longer than 255 characters")
 	}
-	return fields[n]
+	for _, r := range value {
+		if r < ' ' || r > '~' {
+			return errors.New("non printable ascii character")
+		}
+	}
+	return nil
 }
 
+// String encodes the key as its fields, followed by its labels as name=value
+// pairs, joined with the separator. Separator and escape characters inside a
+// field are escaped, see ParseKey.
 func (k Key) String() string {
-	return string(k)
+	var b strings.Builder
+	for i, field := range k.fields() {
+		if i > 0 {
+			b.WriteString(separator)
+		}
+		writeEscaped(&b, field, "|")
+	}
+	if k.labels != "" {
+		b.WriteString(separator)
+		b.WriteString(k.labels)
+	}
+	return b.String()
+}
+
+// WithLabels returns a copy of the key with labels added, replacing the ones
+// with the same name.
+func (k Key) WithLabels(labels ...Label) Key {
+	k.labels = encodeLabels(append(k.Labels(), labels...))
+	return k
+}
+
+// Labels returns the additional dimensions of the key sorted by name.
+func (k Key) Labels() []Label {
+	labels, _ := decodeLabels(k.labels)
+	return labels
+}
+
+// Label returns the value of the named label, or "" when not set.
+func (k Key) Label(name string) string {
+	for _, l := range k.Labels() {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
 }
 
 func (k Key) Node() string {
-	return k.getElement(0)
+	return k.node
 }
 func (k Key) ClientID() string {
-	return k.getElement(1)
+	return k.clientID
 }
 func (k Key) Channel() string {
-	return k.getElement(2)
+	return k.channel
 }
 func (k Key) Group() string {
-	return k.getElement(3)
+	return k.group
 }
 func (k Key) Kind() string {
-	return k.getElement(4)
+	return k.kind
 }
 func (k Key) SubKind() string {
-	return k.getElement(5)
+	return k.subKind
 }
 
-func (k Key) context(ctx context.Context) (context.Context, error) {
+func isFieldKey(k tag.Key) bool {
+	for _, f := range fieldKeys {
+		if f == k {
+			return true
+		}
+	}
+	return false
+}
+
+// value returns the value of the field or label d.
+func (k Key) value(d tag.Key) string {
+	for i, f := range fieldKeys {
+		if f == d {
+			return k.fields()[i]
+		}
+	}
+	return k.Label(d.Name())
+}
+
+// project returns the key with only the fields and labels of dims set.
+func (k Key) project(dims []tag.Key) Key {
+	var p Key
+	var labels []Label
+	for _, d := range dims {
+		switch d {
+		case KeyNode:
+			p.node = k.node
+		case KeyClientID:
+			p.clientID = k.clientID
+		case KeyChannel:
+			p.channel = k.channel
+		case KeyGroup:
+			p.group = k.group
+		case KeyKind:
+			p.kind = k.kind
+		case KeySubKind:
+			p.subKind = k.subKind
+		default:
+			labels = append(labels, Label{Name: d.Name(), Value: k.Label(d.Name())})
+		}
+	}
+	p.labels = encodeLabels(labels)
+	return p
+}
+
+// context returns ctx with the tags of the key. Labels must be tag keys of
+// declared.
+func (k Key) context(ctx context.Context, declared tagKeySet) (context.Context, error) {
 	var mut []tag.Mutator
-	fields := strings.Split(string(k), separator)
-	node := fields[0]
-	clientID := fields[1]
-	channel := fields[2]
-	group := fields[3]
-	kind := fields[4]
-	subKind := fields[5]
-	if node != "" {
-		mut = append(mut, tag.Insert(KeyNode, node))
+	if k.node != "" {
+		mut = append(mut, tag.Insert(KeyNode, k.node))
 	}
-	if clientID != "" {
-		mut = append(mut, tag.Insert(KeyClientID, clientID))
+	if k.clientID != "" {
+		mut = append(mut, tag.Insert(KeyClientID, k.clientID))
 	}
-	if channel != "" {
-		mut = append(mut, tag.Insert(KeyChannel, channel))
+	if k.channel != "" {
+		mut = append(mut, tag.Insert(KeyChannel, k.channel))
 	}
-	if group != "" {
-		mut = append(mut, tag.Insert(KeyGroup, group))
+	if k.group != "" {
+		mut = append(mut, tag.Insert(KeyGroup, k.group))
 	}
-	if kind != "" {
-		mut = append(mut, tag.Insert(KeyKind, kind))
+	if k.kind != "" {
+		mut = append(mut, tag.Insert(KeyKind, k.kind))
 	}
-	if subKind != "" {
-		mut = append(mut, tag.Insert(KeySubKind, subKind))
+	if k.subKind != "" {
+		mut = append(mut, tag.Insert(KeySubKind, k.subKind))
+	}
+	for _, l := range k.Labels() {
+		tk, ok := declared[l.Name]
+		if !ok {
+			return ctx, fmt.Errorf("stats: tag key %q is not declared", l.Name)
+		}
+		mut = append(mut, tag.Insert(tk, l.Value))
 	}
 
 	return tag.New(ctx, mut...)
 }
 
+// Record records the items for k to the default instance, doing nothing
+// before Init.
 func (k Key) Record(items ...Item) error {
-	ms := getMeasurements(items...)
-	ctx, err := ctxCache.get(k)
+	s := Default()
+	if s == nil {
+		return nil
+	}
+	return s.Record(k, items...)
+}
+
+// RecordWithContext records the items to the default instance for the key
+// made of the tags of ctx, doing nothing before Init. Like the keys of Record,
+// it goes through the key cache and counts towards its limits.
+func (k Key) RecordWithContext(ctx context.Context, items ...Item) error {
+	s := Default()
+	if s == nil {
+		return nil
+	}
+	return s.Record(s.contextKey(ctx), items...)
+}
+
+// contextKey returns the key made of the tags of ctx the views aggregate by.
+func (s *Stats) contextKey(ctx context.Context) Key {
+	m := tag.FromContext(ctx)
+	var tags []tag.Tag
+	for _, tk := range s.tagKeys {
+		if v, ok := m.Value(tk); ok {
+			tags = append(tags, tag.Tag{Key: tk, Value: v})
+		}
+	}
+	return makeKeyFromTags(tags)
+}
+
+// Record records the items for key to s.
+func (s *Stats) Record(key Key, items ...Item) error {
+	s.recordMu.RLock()
+	defer s.recordMu.RUnlock()
+	if s.closed {
+		return nil
+	}
+	return s.recordKey(key, items)
+}
+
+// recordKey records the items for key. recordMu must be held for reading.
+func (s *Stats) recordKey(key Key, items []Item) error {
+	ctx, err := s.ctxCache.get(key)
 	if err != nil {
 		return err
 	}
-	ocstats.Record(ctx, ms...)
+	s.record(ctx, items)
 	return nil
 }
 
-func (k Key) RecordWithContext(ctx context.Context, items ...Item) error {
-	ms := getMeasurements(items...)
-	ocstats.Record(ctx, ms...)
-	return nil
+// record records the measurements of items with the tags of ctx. recordMu
+// must be held for reading.
+func (s *Stats) record(ctx context.Context, items []Item) {
+	s.recorder(ctx, s.measurements(items...)...)
 }
 
-func getMeasurements(items ...Item) (ms []ocstats.Measurement) {
+// itemMeasurements is the most measurements an item records, one per field.
+const itemMeasurements = 7
 
-	for i := 0; i < len(items); i++ {
-		if items[i].MsgCount > 0 {
-			ms = append(ms, typeFloatMeasures[typeMsgCount].M(items[i].MsgCount))
-		}
+// measurements returns the measurements of items. The view worker reads them
+// after ocstats.Record returns, so the slice cannot be reused and is allocated
+// once with room for every item.
+func (s *Stats) measurements(items ...Item) []ocstats.Measurement {
+	return s.appendMeasurements(make([]ocstats.Measurement, 0, len(items)*itemMeasurements), items...)
+}
 
-		if items[i].MsgSize > 0 {
-			ms = append(ms, typeFloatMeasures[typeMsgSize].M(items[i].MsgSize))
+// appendMeasurements appends the measurements of items to ms. Counts are one
+// measurement of their value, summed by their views.
+func (s *Stats) appendMeasurements(ms []ocstats.Measurement, items ...Item) []ocstats.Measurement {
+	for i := range items {
+		item := &items[i]
+		if item.MsgCount > 0 {
+			ms = append(ms, s.floatMeasures[typeMsgCount].M(item.MsgCount))
 		}
-		for j := 0; j < int(items[i].Errors); j++ {
-			ms = append(ms, typeIntMeasures[typeErrors].M(1))
+		if item.MsgSize > 0 {
+			ms = append(ms, s.floatMeasures[typeMsgSize].M(item.MsgSize))
 		}
-
-		for j := 0; j < int(items[i].CacheHit); j++ {
-			ms = append(ms, typeIntMeasures[typeCacheHits].M(1))
+		if item.Errors > 0 {
+			ms = append(ms, s.intMeasures[typeErrors].M(item.Errors))
 		}
-		for j := 0; j < int(items[i].CacheMiss); j++ {
-			ms = append(ms, typeIntMeasures[typeCacheMiss].M(1))
+		if item.CacheHit > 0 {
+			ms = append(ms, s.intMeasures[typeCacheHits].M(item.CacheHit))
 		}
-
-		if items[i].Latency > 0 {
-			ms = append(ms, typeFloatMeasures[typeLatency].M(float64(items[i].Latency)/1e6))
+		if item.CacheMiss > 0 {
+			ms = append(ms, s.intMeasures[typeCacheMiss].M(item.CacheMiss))
 		}
-		if items[i].LastUpdate > 0 {
-			ms = append(ms, typeIntMeasures[typeLastUpdate].M(items[i].LastUpdate))
+		if item.Latency > 0 {
+			ms = append(ms, s.floatMeasures[typeLatency].M(float64(item.Latency)/1e6))
+		}
+		if item.LastUpdate > 0 {
+			ms = append(ms, s.intMeasures[typeLastUpdate].M(item.LastUpdate))
 		}
 	}
-
-	return
+	return ms
 }
@@ -0,0 +1,164 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.opencensus.io/tag"
+)
+
+// Label is an additional dimension of a Key. Its name must be declared with
+// WithTagKeys before it can be recorded.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// tagKeySet is the additional tag keys of an instance, declared with
+// WithTagKeys, by name. It does not change after New.
+type tagKeySet map[string]tag.Key
+
+// newTagKeySet declares the additional tag keys named names.
+func newTagKeySet(names []string) (tagKeySet, error) {
+	keys := make(tagKeySet, len(names))
+	for _, name := range names {
+		for _, k := range Keys {
+			if k.Name() == name {
+				return nil, fmt.Errorf("stats: tag key %q is already a fixed key", name)
+			}
+		}
+		k, err := tag.NewKey(name)
+		if err != nil {
+			return nil, fmt.Errorf("stats: invalid tag key %q: %v", name, err)
+		}
+		keys[name] = k
+	}
+	return keys, nil
+}
+
+// sorted returns the tag keys sorted by name.
+func (t tagKeySet) sorted() []tag.Key {
+	sorted := make([]tag.Key, 0, len(t))
+	for _, k := range t {
+		sorted = append(sorted, k)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name() < sorted[j].Name() })
+	return sorted
+}
+
+// dimension returns the tag key named name, one of Keys or a declared tag key.
+func (t tagKeySet) dimension(name string) (tag.Key, bool) {
+	for _, f := range fieldKeys {
+		if f.Name() == name {
+			return f, true
+		}
+	}
+	k, ok := t[name]
+	return k, ok
+}
+
+// encodeLabels returns the canonical form of labels: sorted by name, empty
+// values dropped and the last value winning for duplicated names.
+func encodeLabels(labels []Label) string {
+	m := make(map[string]string, len(labels))
+	for _, l := range labels {
+		m[l.Name] = l.Value
+	}
+	names := make([]string, 0, len(m))
+	for name, value := range m {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(separator)
+		}
+		writeEscaped(&b, name, "|=")
+		b.WriteByte('=')
+		writeEscaped(&b, m[name], "|")
+	}
+	return b.String()
+}
+
+func decodeLabels(s string) ([]Label, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var labels []Label
+	for _, segment := range splitEscaped(s, separator) {
+		i := indexUnescaped(segment, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("stats: invalid label %q", segment)
+		}
+		name, err := unescape(segment[:i])
+		if err != nil {
+			return nil, err
+		}
+		value, err := unescape(segment[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	return labels, nil
+}
+
+func writeEscaped(b *strings.Builder, s, special string) {
+	for i := 0; i < len(s); i++ {
+		if s[i] == escape || strings.IndexByte(special, s[i]) >= 0 {
+			b.WriteByte(escape)
+		}
+		b.WriteByte(s[i])
+	}
+}
+
+// splitEscaped splits s around the separators that are not escaped. The parts
+// are returned still escaped.
+func splitEscaped(s, sep string) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == escape:
+			i++
+		case strings.HasPrefix(s[i:], sep):
+			parts = append(parts, s[start:i])
+			i += len(sep) - 1
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func indexUnescaped(s string, c byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case escape:
+			i++
+		case c:
+			return i
+		}
+	}
+	return -1
+}
+
+func unescape(s string) (string, error) {
+	if strings.IndexByte(s, escape) < 0 {
+		return s, nil
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == escape {
+			if i+1 == len(s) {
+				return "", fmt.Errorf("stats: dangling escape in %q", s)
+			}
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b), nil
+}
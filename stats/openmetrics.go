@@ -0,0 +1,207 @@
+package stats
+
+import (
+	"bufio"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// derivedGauge is a value computed from the totals of a ChannelSummary, which
+// the views do not expose.
+type derivedGauge struct {
+	name  string
+	help  string
+	unit  string
+	value func(cs *ChannelSummary) float64
+}
+
+var derivedGauges = []derivedGauge{
+	{
+		name:  "channel_error_rate_percent",
+		help:  "Percentage of the messages that failed.",
+		unit:  "percent",
+		value: func(cs *ChannelSummary) float64 { return cs.ErrorRate },
+	},
+	{
+		name:  "channel_success_rate_percent",
+		help:  "Percentage of the messages that did not fail.",
+		unit:  "percent",
+		value: func(cs *ChannelSummary) float64 { return cs.SuccessRate },
+	},
+	{
+		name:  "channel_cache_hits_ratio",
+		help:  "Ratio of the cache lookups that hit.",
+		unit:  "ratio",
+		value: func(cs *ChannelSummary) float64 { return cs.CacheHitsRatio },
+	},
+	{
+		name:  "channel_avg_msg_size_bytes",
+		help:  "Average size of the messages.",
+		unit:  "bytes",
+		value: func(cs *ChannelSummary) float64 { return cs.AvgMsgSize },
+	},
+	{
+		name:  "channel_avg_latency_seconds",
+		help:  "Average latency of the requests.",
+		unit:  "seconds",
+		value: func(cs *ChannelSummary) float64 { return cs.AvgLatency / 1000 },
+	},
+}
+
+// derivedSeries is the label values and summary of a key.
+type derivedSeries struct {
+	labels []string
+	cs     *ChannelSummary
+}
+
+// derivedSeriesOf returns the series of the cumulative summaries sorted by key,
+// with the values of the labels names.
+func (s *Stats) derivedSeriesOf(names []string) []derivedSeries {
+	m, _ := s.Snapshot()
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]derivedSeries, 0, len(keys))
+	for _, k := range keys {
+		key, err := ParseKey(k)
+		if err != nil {
+			continue
+		}
+		labels := make([]string, len(names))
+		for i, name := range names {
+			d, _ := s.declared.dimension(name)
+			labels[i] = key.value(d)
+		}
+		series = append(series, derivedSeries{labels: labels, cs: m[k]})
+	}
+	return series
+}
+
+// derivedLabels returns the label names of the derived gauges: the key fields
+// followed by the declared tag keys.
+func (s *Stats) derivedLabels() []string {
+	names := make([]string, 0, numFields+len(s.declared))
+	for _, k := range fieldKeys {
+		names = append(names, k.Name())
+	}
+	for _, k := range s.declared.sorted() {
+		names = append(names, k.Name())
+	}
+	return names
+}
+
+func (s *Stats) derivedName(g derivedGauge) string {
+	return prometheus.BuildFQName(s.opts.namespace, "", g.name)
+}
+
+// GetSummaryCollector returns a prometheus.Collector of the gauges derived
+// from the cumulative summaries of the internal exporter: error and success
+// rates, cache hits ratio, average message size and average latency, labeled
+// by the key fields and declared tag keys and by the labels set with
+// WithPrometheusConstLabels.
+func (s *Stats) GetSummaryCollector() prometheus.Collector {
+	c := &summaryCollector{stats: s, labels: s.derivedLabels()}
+	for _, g := range derivedGauges {
+		c.descs = append(c.descs, prometheus.NewDesc(s.derivedName(g), g.help, c.labels, s.opts.promConstLabels))
+	}
+	return c
+}
+
+type summaryCollector struct {
+	stats  *Stats
+	labels []string
+	descs  []*prometheus.Desc
+}
+
+func (c *summaryCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.descs {
+		ch <- d
+	}
+}
+
+func (c *summaryCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, series := range c.stats.derivedSeriesOf(c.labels) {
+		for i, g := range derivedGauges {
+			ch <- prometheus.MustNewConstMetric(c.descs[i], prometheus.GaugeValue, g.value(series.cs), series.labels...)
+		}
+	}
+}
+
+// GetOpenMetricsHandler returns a handler serving the gauges of
+// GetSummaryCollector, with the same labels, in the OpenMetrics text format.
+func (s *Stats) GetOpenMetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		labels := s.derivedLabels()
+		series := s.derivedSeriesOf(labels)
+		constNames, constValues := sortedLabels(s.opts.promConstLabels)
+		names := append(append([]string(nil), labels...), constNames...)
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		b := bufio.NewWriter(w)
+		for _, g := range derivedGauges {
+			name := s.derivedName(g)
+			b.WriteString("# TYPE " + name + " gauge\n")
+			b.WriteString("# UNIT " + name + " " + g.unit + "\n")
+			b.WriteString("# HELP " + name + " " + escapeOpenMetrics(g.help, false) + "\n")
+			for _, ser := range series {
+				b.WriteString(name)
+				writeOpenMetricsLabels(b, names, append(append(make([]string, 0, len(names)), ser.labels...), constValues...))
+				b.WriteByte(' ')
+				b.WriteString(strconv.FormatFloat(g.value(ser.cs), 'g', -1, 64))
+				b.WriteByte('\n')
+			}
+		}
+		b.WriteString("# EOF\n")
+		b.Flush()
+	})
+}
+
+// sortedLabels returns the names of labels sorted and their values.
+func sortedLabels(labels map[string]string) (names, values []string) {
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values = append(values, labels[name])
+	}
+	return names, values
+}
+
+// writeOpenMetricsLabels writes the labels with a non-empty value.
+func writeOpenMetricsLabels(b *bufio.Writer, names, values []string) {
+	first := true
+	for i, value := range values {
+		if value == "" {
+			continue
+		}
+		if first {
+			b.WriteByte('{')
+			first = false
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(names[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeOpenMetrics(value, true))
+		b.WriteByte('"')
+	}
+	if !first {
+		b.WriteByte('}')
+	}
+}
+
+// escapeOpenMetrics escapes backslashes and line feeds, and double quotes in
+// label values.
+func escapeOpenMetrics(s string, quote bool) string {
+	r := strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	if quote {
+		r = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	}
+	return r.Replace(s)
+}
@@ -0,0 +1,92 @@
+package stats
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenMetrics_DerivedGauges(t *testing.T) {
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter())
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+	key := GetKey("node_openmetrics", "client_openmetrics", `some"channel`, "", "publish", "")
+	require.NoError(t, key.Record(
+		Item{MsgCount: 1, MsgSize: 100, CacheHit: 1, Latency: 10 * time.Millisecond},
+		Item{MsgCount: 3, MsgSize: 300, CacheMiss: 1, Errors: 1, Latency: 30 * time.Millisecond},
+	))
+	time.Sleep(100 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	s.GetOpenMetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "application/openmetrics-text; version=1.0.0; charset=utf-8", rec.Header().Get("Content-Type"))
+	body, _ := ioutil.ReadAll(rec.Body)
+	text := string(body)
+	labels := `{node="node_openmetrics",client_id="client_openmetrics",channel="some\"channel",kind="publish"}`
+	assert.Contains(t, text, "# TYPE channel_error_rate_percent gauge\n# UNIT channel_error_rate_percent percent\n# HELP channel_error_rate_percent ")
+	assert.Contains(t, text, "channel_error_rate_percent"+labels+" 25\n")
+	assert.Contains(t, text, "channel_success_rate_percent"+labels+" 75\n")
+	assert.Contains(t, text, "channel_cache_hits_ratio"+labels+" 0.5\n")
+	assert.Contains(t, text, "channel_avg_msg_size_bytes"+labels+" 100\n")
+	assert.Contains(t, text, "channel_avg_latency_seconds"+labels+" 0.02\n")
+	assert.True(t, strings.HasSuffix(text, "# EOF\n"))
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(s.GetSummaryCollector()))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	require.Len(t, families, len(derivedGauges))
+	found := false
+	for _, f := range families {
+		if f.GetName() != "channel_cache_hits_ratio" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "client_id" && l.GetValue() == "client_openmetrics" {
+					found = true
+					assert.EqualValues(t, 0.5, m.GetGauge().GetValue())
+				}
+			}
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestOpenMetrics_ConstLabels(t *testing.T) {
+	s, err := New(WithExportInterval(10*time.Millisecond), WithInternalExporter(),
+		WithPrometheus("", nil), WithPrometheusConstLabels(map[string]string{"env": "test", "dc": "eu"}))
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+	key := GetKey("node_openmetrics_const", "client_openmetrics_const", "some_channel", "", "publish", "")
+	require.NoError(t, s.Record(key, Item{MsgCount: 1, Errors: 1}))
+	time.Sleep(100 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	s.GetOpenMetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	assert.Contains(t, string(body), `channel_error_rate_percent{node="node_openmetrics_const",client_id="client_openmetrics_const",channel="some_channel",kind="publish",dc="eu",env="test"} 100`+"\n")
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(s.GetSummaryCollector()))
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			assert.Equal(t, "test", labels["env"])
+			assert.Equal(t, "eu", labels["dc"])
+		}
+	}
+}
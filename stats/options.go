@@ -1,6 +1,10 @@
 package stats
 
-import "time"
+import (
+	"time"
+
+	promclient "github.com/prometheus/client_golang/prometheus"
+)
 
 type statsOptions struct {
 	exportInterval         time.Duration
@@ -8,6 +12,21 @@ type statsOptions struct {
 	enablePrometheus       bool
 	namespace              string
 	errFunc                func(err error)
+	latencyBuckets         []float64
+	msgSizeBuckets         []float64
+	tagKeys                []string
+	windows                []time.Duration
+	rateSmoothing          time.Duration
+	approxPrecision        uint8
+	statsd                 *StatsDOptions
+	influx                 *InfluxOptions
+	graphite               *GraphiteOptions
+	otlp                   *OTLPOptions
+	file                   *FileOptions
+	maxKeys                int
+	keyTTL                 time.Duration
+	promRegistry           *promclient.Registry
+	promConstLabels        map[string]string
 }
 
 type StateOption interface {
@@ -39,9 +58,136 @@ func WithExportInterval(t time.Duration) StateOption {
 		o.exportInterval = t
 	})
 }
+
+// WithPrometheus exposes the views to Prometheus, see GetPrometheusHandler.
 func WithPrometheus(namespace string, errFunc func(err error)) StateOption {
 	return newFuncDialOption(func(o *statsOptions) {
+		o.enablePrometheus = true
 		o.namespace = namespace
 		o.errFunc = errFunc
 	})
 }
+
+// WithPrometheusRegistry registers the Prometheus collector of the views in
+// reg rather than in a registry of its own. It takes effect with
+// WithPrometheus.
+func WithPrometheusRegistry(reg *promclient.Registry) StateOption {
+	return newFuncDialOption(func(o *statsOptions) {
+		o.promRegistry = reg
+	})
+}
+
+// WithPrometheusConstLabels adds labels with a constant value to every metric
+// exposed to Prometheus. It takes effect with WithPrometheus.
+func WithPrometheusConstLabels(labels map[string]string) StateOption {
+	return newFuncDialOption(func(o *statsOptions) {
+		o.promConstLabels = labels
+	})
+}
+
+// WithLatencyBuckets sets the bounds, in milliseconds, of the latency
+// histogram. See ExponentialBuckets and LinearBuckets.
+func WithLatencyBuckets(buckets ...float64) StateOption {
+	return newFuncDialOption(func(o *statsOptions) {
+		o.latencyBuckets = buckets
+	})
+}
+
+// WithMsgSizeBuckets sets the bounds, in bytes, of the message size
+// histogram.
+func WithMsgSizeBuckets(buckets ...float64) StateOption {
+	return newFuncDialOption(func(o *statsOptions) {
+		o.msgSizeBuckets = buckets
+	})
+}
+
+// WithTagKeys declares additional tag keys, beside the fixed Keys, that can be
+// set on a Key as labels when recorded to the instance.
+func WithTagKeys(names ...string) StateOption {
+	return newFuncDialOption(func(o *statsOptions) {
+		o.tagKeys = names
+	})
+}
+
+// WithWindows sets the rolling windows kept by the internal exporter, 1, 5 and
+// 15 minutes by default.
+func WithWindows(windows ...time.Duration) StateOption {
+	return newFuncDialOption(func(o *statsOptions) {
+		o.windows = windows
+	})
+}
+
+// WithRateSmoothing sets the time constant of the smoothed rates, one minute
+// by default.
+func WithRateSmoothing(tau time.Duration) StateOption {
+	return newFuncDialOption(func(o *statsOptions) {
+		o.rateSmoothing = tau
+	})
+}
+
+// WithApproximateDistinct counts the distinct active clients, channels, groups
+// and nodes with HyperLogLog sketches of 2^precision registers, for very high
+// cardinalities. precision is clamped to [4, 16].
+func WithApproximateDistinct(precision uint8) StateOption {
+	return newFuncDialOption(func(o *statsOptions) {
+		o.approxPrecision = precision
+	})
+}
+
+// WithMaxKeys limits the number of distinct keys recorded, the recordings of
+// the keys beyond the limit being folded into OverflowKey until some are
+// evicted, see WithKeyTTL. This bounds the memory of the key cache, the views
+// and the internal exporter. Unlimited by default.
+func WithMaxKeys(n int) StateOption {
+	return newFuncDialOption(func(o *statsOptions) {
+		o.maxKeys = n
+	})
+}
+
+// WithKeyTTL evicts the keys not recorded for ttl from the key cache, the
+// views and the internal exporter, checked every export interval. An evicted
+// key recorded again starts over from zero. Keys are never evicted by default.
+func WithKeyTTL(ttl time.Duration) StateOption {
+	return newFuncDialOption(func(o *statsOptions) {
+		o.keyTTL = ttl
+	})
+}
+
+// WithStatsD pushes the views to a StatsD agent over UDP, with the key fields
+// and labels as DogStatsD tags.
+func WithStatsD(opts StatsDOptions) StateOption {
+	return newFuncDialOption(func(o *statsOptions) {
+		o.statsd = &opts
+	})
+}
+
+// WithInflux writes the views as InfluxDB line protocol to an HTTP write
+// endpoint or a file.
+func WithInflux(opts InfluxOptions) StateOption {
+	return newFuncDialOption(func(o *statsOptions) {
+		o.influx = &opts
+	})
+}
+
+// WithGraphite sends the views to a Graphite carbon listener over TCP, with
+// paths built from a template.
+func WithGraphite(opts GraphiteOptions) StateOption {
+	return newFuncDialOption(func(o *statsOptions) {
+		o.graphite = &opts
+	})
+}
+
+// WithOTLP sends the views to an OpenTelemetry collector over OTLP/HTTP.
+func WithOTLP(opts OTLPOptions) StateOption {
+	return newFuncDialOption(func(o *statsOptions) {
+		o.otlp = &opts
+	})
+}
+
+// WithFileExporter appends the summaries of every interval to a rotating file.
+// It needs WithInternalExporter.
+func WithFileExporter(opts FileOptions) StateOption {
+	return newFuncDialOption(func(o *statsOptions) {
+		o.file = &opts
+	})
+}
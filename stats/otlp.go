@@ -0,0 +1,388 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats/view"
+)
+
+const (
+	defaultOTLPEndpoint    = "http://localhost:4318/v1/metrics"
+	defaultOTLPServiceName = "kubemq"
+	defaultOTLPTimeout     = 10 * time.Second
+	otlpQueueSize          = 64
+	otlpScopeLibrary       = "github.com/liornabat/opencensus-poc/stats"
+)
+
+// OTLPOptions configures the OTLP exporter enabled with WithOTLP.
+type OTLPOptions struct {
+	// Endpoint is the OTLP/HTTP metrics URL,
+	// http://localhost:4318/v1/metrics by default.
+	Endpoint string
+	// Header is added to every request, for instance to authenticate.
+	Header http.Header
+	// Client sends the requests, a client with a 10 seconds timeout by
+	// default.
+	Client *http.Client
+	// ServiceName is the service.name resource attribute, kubemq by default.
+	ServiceName string
+	// Prefix is prepended, followed by a dot, to every metric name.
+	Prefix string
+	// OnError is called when a request fails or is dropped because too many
+	// are pending, the error is logged by default.
+	OnError func(err error)
+}
+
+// OTLP field numbers, from the opentelemetry-proto metrics, resource and
+// common definitions.
+const (
+	otlpRequestResourceMetrics = 1
+
+	otlpResourceMetricsResource = 1
+	otlpResourceMetricsScope    = 2
+
+	otlpResourceAttributes = 1
+
+	otlpScopeMetricsScope   = 1
+	otlpScopeMetricsMetrics = 2
+	otlpScopeName           = 1
+
+	otlpKeyValueKey   = 1
+	otlpKeyValueValue = 2
+	otlpAnyValueStr   = 1
+
+	otlpMetricName        = 1
+	otlpMetricDescription = 2
+	otlpMetricUnit        = 3
+	otlpMetricGauge       = 5
+	otlpMetricSum         = 7
+	otlpMetricHistogram   = 9
+
+	otlpDataPoints            = 1
+	otlpTemporality           = 2
+	otlpSumIsMonotonic        = 3
+	otlpTemporalityCumulative = 2
+
+	otlpNumberStart      = 2
+	otlpNumberTime       = 3
+	otlpNumberAsDouble   = 4
+	otlpNumberAsInt      = 6
+	otlpNumberAttributes = 7
+
+	otlpHistogramStart      = 2
+	otlpHistogramTime       = 3
+	otlpHistogramCount      = 4
+	otlpHistogramSum        = 5
+	otlpHistogramBuckets    = 6
+	otlpHistogramBounds     = 7
+	otlpHistogramAttributes = 9
+	otlpHistogramMin        = 11
+	otlpHistogramMax        = 12
+)
+
+// otlpExporter sends the views as OTLP/HTTP protobuf requests. Every node
+// becomes a resource, identified by the service.instance.id and node
+// attributes, and the other key fields and labels become data point
+// attributes. Counts and sums are monotonic cumulative sums, last values
+// gauges and distributions cumulative histograms. Requests are sent by a
+// background goroutine so exporting never blocks the recording.
+type otlpExporter struct {
+	opts  OTLPOptions
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+	wg    sync.WaitGroup
+}
+
+func newOTLPExporter(opts OTLPOptions) *otlpExporter {
+	if opts.Endpoint == "" {
+		opts.Endpoint = defaultOTLPEndpoint
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: defaultOTLPTimeout}
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = defaultOTLPServiceName
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(err error) {
+			log.Printf("Failed to export to OTLP: %v", err)
+		}
+	}
+	e := &otlpExporter{
+		opts:  opts,
+		queue: make(chan []byte, otlpQueueSize),
+		done:  make(chan struct{}),
+	}
+	e.wg.Add(1)
+	go e.run()
+	return e
+}
+
+func (e *otlpExporter) ExportView(vd *view.Data) {
+	if _, ok := statTypeOf(vd.View.Name); !ok || len(vd.Rows) == 0 {
+		return
+	}
+	select {
+	case <-e.done:
+		return
+	default:
+	}
+	select {
+	case e.queue <- e.encode(vd):
+	default:
+		e.opts.OnError(fmt.Errorf("stats: dropped OTLP export of %s, too many pending requests", vd.View.Name))
+	}
+}
+
+// encode returns the ExportMetricsServiceRequest of vd.
+func (e *otlpExporter) encode(vd *view.Data) []byte {
+	byNode := make(map[string][]*view.Row)
+	for _, row := range vd.Rows {
+		node := makeKeyFromTags(row.Tags).node
+		byNode[node] = append(byNode[node], row)
+	}
+	nodes := make([]string, 0, len(byNode))
+	for node := range byNode {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	var req pbBuffer
+	for _, node := range nodes {
+		rows := byNode[node]
+		req.message(otlpRequestResourceMetrics, func(rm *pbBuffer) {
+			rm.message(otlpResourceMetricsResource, func(r *pbBuffer) {
+				otlpAttribute(r, otlpResourceAttributes, "service.name", e.opts.ServiceName)
+				if node != "" {
+					otlpAttribute(r, otlpResourceAttributes, "service.instance.id", node)
+					otlpAttribute(r, otlpResourceAttributes, KeyNode.Name(), node)
+				}
+			})
+			rm.message(otlpResourceMetricsScope, func(sm *pbBuffer) {
+				sm.message(otlpScopeMetricsScope, func(s *pbBuffer) {
+					s.str(otlpScopeName, otlpScopeLibrary)
+				})
+				sm.message(otlpScopeMetricsMetrics, func(m *pbBuffer) {
+					e.encodeMetric(m, vd, rows)
+				})
+			})
+		})
+	}
+	return req.b
+}
+
+func (e *otlpExporter) encodeMetric(m *pbBuffer, vd *view.Data, rows []*view.Row) {
+	name := vd.View.Name
+	if e.opts.Prefix != "" {
+		name = e.opts.Prefix + "." + name
+	}
+	m.str(otlpMetricName, name)
+	description := vd.View.Description
+	if description == "" && vd.View.Measure != nil {
+		description = vd.View.Measure.Description()
+	}
+	m.str(otlpMetricDescription, description)
+	if vd.View.Measure != nil {
+		m.str(otlpMetricUnit, vd.View.Measure.Unit())
+	}
+	start, end := uint64(vd.Start.UnixNano()), uint64(vd.End.UnixNano())
+	switch vd.View.Aggregation.Type {
+	case view.AggTypeCount, view.AggTypeSum:
+		m.message(otlpMetricSum, func(sum *pbBuffer) {
+			for _, row := range rows {
+				sum.message(otlpDataPoints, func(p *pbBuffer) {
+					otlpRowAttributes(p, otlpNumberAttributes, row)
+					p.fixed64(otlpNumberStart, start)
+					p.fixed64(otlpNumberTime, end)
+					switch v := row.Data.(type) {
+					case *view.CountData:
+						p.fixed64(otlpNumberAsInt, uint64(v.Value))
+					case *view.SumData:
+						p.double(otlpNumberAsDouble, v.Value)
+					}
+				})
+			}
+			sum.varint(otlpTemporality, otlpTemporalityCumulative)
+			sum.varint(otlpSumIsMonotonic, 1)
+		})
+	case view.AggTypeLastValue:
+		m.message(otlpMetricGauge, func(gauge *pbBuffer) {
+			for _, row := range rows {
+				v, ok := row.Data.(*view.LastValueData)
+				if !ok {
+					continue
+				}
+				gauge.message(otlpDataPoints, func(p *pbBuffer) {
+					otlpRowAttributes(p, otlpNumberAttributes, row)
+					p.fixed64(otlpNumberTime, end)
+					p.double(otlpNumberAsDouble, v.Value)
+				})
+			}
+		})
+	case view.AggTypeDistribution:
+		m.message(otlpMetricHistogram, func(hist *pbBuffer) {
+			for _, row := range rows {
+				v, ok := row.Data.(*view.DistributionData)
+				if !ok {
+					continue
+				}
+				hist.message(otlpDataPoints, func(p *pbBuffer) {
+					otlpRowAttributes(p, otlpHistogramAttributes, row)
+					p.fixed64(otlpHistogramStart, start)
+					p.fixed64(otlpHistogramTime, end)
+					p.fixed64(otlpHistogramCount, uint64(v.Count))
+					p.double(otlpHistogramSum, v.Sum())
+					counts := make([]uint64, len(v.CountPerBucket))
+					for i, c := range v.CountPerBucket {
+						counts[i] = uint64(c)
+					}
+					p.packedFixed64(otlpHistogramBuckets, counts)
+					bounds := make([]uint64, len(vd.View.Aggregation.Buckets))
+					for i, b := range vd.View.Aggregation.Buckets {
+						bounds[i] = math.Float64bits(b)
+					}
+					p.packedFixed64(otlpHistogramBounds, bounds)
+					if v.Count > 0 {
+						p.double(otlpHistogramMin, v.Min)
+						p.double(otlpHistogramMax, v.Max)
+					}
+				})
+			}
+			hist.varint(otlpTemporality, otlpTemporalityCumulative)
+		})
+	}
+}
+
+// otlpRowAttributes writes the tags of row, but the node which is a resource
+// attribute.
+func otlpRowAttributes(p *pbBuffer, field int, row *view.Row) {
+	for _, t := range row.Tags {
+		if t.Key != KeyNode && t.Value != "" {
+			otlpAttribute(p, field, t.Key.Name(), t.Value)
+		}
+	}
+}
+
+func otlpAttribute(p *pbBuffer, field int, key, value string) {
+	p.message(field, func(kv *pbBuffer) {
+		kv.str(otlpKeyValueKey, key)
+		kv.message(otlpKeyValueValue, func(v *pbBuffer) {
+			v.str(otlpAnyValueStr, value)
+		})
+	})
+}
+
+func (e *otlpExporter) run() {
+	defer e.wg.Done()
+	for {
+		select {
+		case body := <-e.queue:
+			e.send(body)
+		case <-e.done:
+			for {
+				select {
+				case body := <-e.queue:
+					e.send(body)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *otlpExporter) send(body []byte) {
+	req, err := http.NewRequest(http.MethodPost, e.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		e.opts.OnError(err)
+		return
+	}
+	for name, values := range e.opts.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	resp, err := e.opts.Client.Do(req)
+	if err != nil {
+		e.opts.OnError(err)
+		return
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		e.opts.OnError(fmt.Errorf("stats: OTLP export returned %s: %s", resp.Status, strings.TrimSpace(string(msg))))
+	}
+}
+
+// close sends the pending requests and stops the exporter.
+func (e *otlpExporter) close() {
+	e.once.Do(func() {
+		close(e.done)
+		e.wg.Wait()
+	})
+}
+
+// pbBuffer appends protobuf wire format fields.
+type pbBuffer struct {
+	b []byte
+}
+
+func (p *pbBuffer) tag(field, wire int) {
+	p.uvarint(uint64(field)<<3 | uint64(wire))
+}
+
+func (p *pbBuffer) uvarint(v uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], v)
+	p.b = append(p.b, scratch[:n]...)
+}
+
+func (p *pbBuffer) varint(field int, v uint64) {
+	p.tag(field, 0)
+	p.uvarint(v)
+}
+
+func (p *pbBuffer) fixed64(field int, v uint64) {
+	p.tag(field, 1)
+	var scratch [8]byte
+	binary.LittleEndian.PutUint64(scratch[:], v)
+	p.b = append(p.b, scratch[:]...)
+}
+
+func (p *pbBuffer) double(field int, v float64) {
+	p.fixed64(field, math.Float64bits(v))
+}
+
+func (p *pbBuffer) bytes(field int, b []byte) {
+	p.tag(field, 2)
+	p.uvarint(uint64(len(b)))
+	p.b = append(p.b, b...)
+}
+
+func (p *pbBuffer) str(field int, s string) {
+	p.bytes(field, []byte(s))
+}
+
+func (p *pbBuffer) packedFixed64(field int, values []uint64) {
+	b := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(b[8*i:], v)
+	}
+	p.bytes(field, b)
+}
+
+// message writes the embedded message written by f.
+func (p *pbBuffer) message(field int, f func(m *pbBuffer)) {
+	var m pbBuffer
+	f(&m)
+	p.bytes(field, m.b)
+}
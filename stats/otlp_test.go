@@ -0,0 +1,137 @@
+package stats
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pbMessage is a decoded protobuf message: the values of every field, varints
+// and fixed64 as numbers and length-delimited as bytes.
+type pbMessage map[int][]interface{}
+
+func decodePB(t *testing.T, b []byte) pbMessage {
+	m := pbMessage{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		require.True(t, n > 0)
+		b = b[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			require.True(t, n > 0)
+			b = b[n:]
+			m[field] = append(m[field], v)
+		case 1:
+			require.True(t, len(b) >= 8)
+			m[field] = append(m[field], binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			require.True(t, n > 0 && len(b) >= n+int(l))
+			m[field] = append(m[field], b[n:n+int(l)])
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return m
+}
+
+func (m pbMessage) message(t *testing.T, field int) []pbMessage {
+	var msgs []pbMessage
+	for _, v := range m[field] {
+		msgs = append(msgs, decodePB(t, v.([]byte)))
+	}
+	return msgs
+}
+
+func (m pbMessage) str(field int) string {
+	if len(m[field]) == 0 {
+		return ""
+	}
+	return string(m[field][0].([]byte))
+}
+
+func pbAttributes(t *testing.T, msgs []pbMessage) map[string]string {
+	attrs := map[string]string{}
+	for _, kv := range msgs {
+		attrs[kv.str(otlpKeyValueKey)] = kv.message(t, otlpKeyValueValue)[0].str(otlpAnyValueStr)
+	}
+	return attrs
+}
+
+func TestOTLP_Export(t *testing.T) {
+	requests := make(chan []byte, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- body
+	}))
+	defer server.Close()
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithOTLP(OTLPOptions{
+		Endpoint:    server.URL + "/v1/metrics",
+		ServiceName: "broker",
+		OnError:     func(err error) { t.Error(err) },
+	}))
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+
+	key := GetKey("node_otlp", "client_otlp", "some_channel", "", "publish", "")
+	require.NoError(t, key.Record(Item{MsgCount: 2, Errors: 1, Latency: 10 * time.Millisecond}))
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, s.Close(context.Background()))
+	close(requests)
+
+	metrics := map[string]pbMessage{}
+	for body := range requests {
+		for _, rm := range decodePB(t, body).message(t, otlpRequestResourceMetrics) {
+			resource := rm.message(t, otlpResourceMetricsResource)[0]
+			attrs := pbAttributes(t, resource.message(t, otlpResourceAttributes))
+			if attrs["node"] != "node_otlp" {
+				continue
+			}
+			assert.Equal(t, "broker", attrs["service.name"])
+			assert.Equal(t, "node_otlp", attrs["service.instance.id"])
+			for _, sm := range rm.message(t, otlpResourceMetricsScope) {
+				for _, metric := range sm.message(t, otlpScopeMetricsMetrics) {
+					metrics[metric.str(otlpMetricName)] = metric
+				}
+			}
+		}
+	}
+
+	errors, ok := metrics["total_errors"]
+	require.True(t, ok)
+	sum := errors.message(t, otlpMetricSum)[0]
+	assert.EqualValues(t, otlpTemporalityCumulative, sum[otlpTemporality][0])
+	assert.EqualValues(t, 1, sum[otlpSumIsMonotonic][0])
+	point := sum.message(t, otlpDataPoints)[0]
+	assert.EqualValues(t, 1, point[otlpNumberAsInt][0])
+	assert.Equal(t, map[string]string{"client_id": "client_otlp", "channel": "some_channel", "kind": "publish"},
+		pbAttributes(t, point.message(t, otlpNumberAttributes)))
+
+	messages, ok := metrics["total_messages"]
+	require.True(t, ok)
+	point = messages.message(t, otlpMetricSum)[0].message(t, otlpDataPoints)[0]
+	assert.EqualValues(t, 2, math.Float64frombits(point[otlpNumberAsDouble][0].(uint64)))
+
+	latency, ok := metrics["total_latency"]
+	require.True(t, ok)
+	assert.Equal(t, "ms", latency.str(otlpMetricUnit))
+	point = latency.message(t, otlpMetricHistogram)[0].message(t, otlpDataPoints)[0]
+	assert.EqualValues(t, 1, point[otlpHistogramCount][0])
+	assert.EqualValues(t, 10, math.Float64frombits(point[otlpHistogramSum][0].(uint64)))
+	assert.Len(t, point[otlpHistogramBounds][0], 8*len(defaultLatencyBuckets))
+	assert.Len(t, point[otlpHistogramBuckets][0], 8*(len(defaultLatencyBuckets)+1))
+}
@@ -0,0 +1,73 @@
+package stats
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"go.opencensus.io/exporter/prometheus"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var promLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// promAdapter feeds the views to the Prometheus exporter, which needs a value
+// for every tag key of a view in the order of its TagKeys while rows only hold
+// the tags that were set, sorted by name. The constant labels are added as
+// extra tag keys.
+type promAdapter struct {
+	exporter  *prometheus.Exporter
+	constKeys []tag.Key
+	constTags []tag.Tag
+}
+
+func newPromAdapter(exporter *prometheus.Exporter, constLabels map[string]string, tagKeys []tag.Key) (*promAdapter, error) {
+	a := &promAdapter{exporter: exporter}
+	names := make([]string, 0, len(constLabels))
+	for name := range constLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !promLabelName.MatchString(name) {
+			return nil, fmt.Errorf("stats: invalid prometheus label name %q", name)
+		}
+		for _, k := range tagKeys {
+			if k.Name() == name {
+				return nil, fmt.Errorf("stats: prometheus label %q is a tag key", name)
+			}
+		}
+		k, err := tag.NewKey(name)
+		if err != nil {
+			return nil, err
+		}
+		a.constKeys = append(a.constKeys, k)
+		a.constTags = append(a.constTags, tag.Tag{Key: k, Value: constLabels[name]})
+	}
+	return a, nil
+}
+
+func (a *promAdapter) ExportView(vd *view.Data) {
+	if len(vd.Rows) == 0 {
+		return
+	}
+	v := *vd.View
+	v.TagKeys = append(append([]tag.Key(nil), vd.View.TagKeys...), a.constKeys...)
+	rows := make([]*view.Row, len(vd.Rows))
+	for i, row := range vd.Rows {
+		tags := make([]tag.Tag, 0, len(v.TagKeys))
+		for _, k := range vd.View.TagKeys {
+			t := tag.Tag{Key: k}
+			for _, rt := range row.Tags {
+				if rt.Key == k {
+					t.Value = rt.Value
+					break
+				}
+			}
+			tags = append(tags, t)
+		}
+		rows[i] = &view.Row{Tags: append(tags, a.constTags...), Data: row.Data}
+	}
+	a.exporter.ExportView(&view.Data{View: &v, Start: vd.Start, End: vd.End, Rows: rows})
+}
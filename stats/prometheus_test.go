@@ -0,0 +1,49 @@
+package stats
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	promclient "github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheus_Scrape(t *testing.T) {
+	reg := promclient.NewRegistry()
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter(),
+		WithPrometheus("kubemq", func(err error) { t.Error(err) }),
+		WithPrometheusRegistry(reg),
+		WithPrometheusConstLabels(map[string]string{"env": "test"}))
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+	require.NotNil(t, s.GetPrometheusHandler())
+	require.NoError(t, reg.Register(s.GetSummaryCollector()))
+
+	key := GetKey("node_prom", "client_prom", "some_channel", "", "publish", "")
+	require.NoError(t, key.Record(Item{MsgCount: 2, Errors: 1, Latency: 10 * time.Millisecond}))
+	time.Sleep(100 * time.Millisecond)
+
+	server := httptest.NewServer(s.GetPrometheusHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	text := string(body)
+	assert.Contains(t, text, `kubemq_total_errors{channel="some_channel",client_id="client_prom",env="test",group="",kind="publish",node="node_prom",sub_kind=""} 1`)
+	assert.Contains(t, text, `kubemq_total_messages{channel="some_channel",client_id="client_prom",env="test",group="",kind="publish",node="node_prom",sub_kind=""} 2`)
+	assert.Contains(t, text, `kubemq_total_latency_count{channel="some_channel",client_id="client_prom",env="test",group="",kind="publish",node="node_prom",sub_kind=""} 1`)
+	assert.Contains(t, text, `kubemq_channel_error_rate_percent{channel="some_channel",client_id="client_prom",env="test",group="",kind="publish",node="node_prom",sub_kind=""} 50`)
+
+	_, err = Init(WithPrometheus("kubemq", nil), WithPrometheusConstLabels(map[string]string{"node": "x"}))
+	assert.Error(t, err)
+	_, err = Init(WithPrometheus("kubemq", nil), WithPrometheusConstLabels(map[string]string{"bad-name": "x"}))
+	assert.Error(t, err)
+}
@@ -0,0 +1,60 @@
+package stats
+
+import (
+	"math"
+	"time"
+)
+
+const defaultRateSmoothing = time.Minute
+
+// ewma is an exponentially weighted moving average of the per second rate of
+// a cumulative value, updated every time the value is reported.
+type ewma struct {
+	at    time.Time
+	last  float64
+	value float64
+	ready bool
+}
+
+// observe folds the change of the cumulative value since the previous report
+// into the average. tau is the time constant of the smoothing.
+func (e *ewma) observe(at time.Time, cumulative float64, tau time.Duration) {
+	if e.at.IsZero() {
+		e.at, e.last = at, cumulative
+		return
+	}
+	span := at.Sub(e.at)
+	if span <= 0 {
+		return
+	}
+	diff := cumulative - e.last
+	if diff < 0 {
+		diff = cumulative
+	}
+	rate := diff / span.Seconds()
+	if !e.ready {
+		e.value, e.ready = rate, true
+	} else {
+		alpha := 1 - math.Exp(-span.Seconds()/tau.Seconds())
+		e.value += alpha * (rate - e.value)
+	}
+	e.at, e.last = at, cumulative
+}
+
+func (e *ewma) rate() float64 {
+	return e.value
+}
+
+// rater is implemented by the aggregators of counts and sums, which keep a
+// smoothed rate next to their cumulative value.
+type rater interface {
+	observe(at time.Time, tau time.Duration)
+	rate() float64
+}
+
+func perSecond(value float64, span time.Duration) float64 {
+	if span <= 0 {
+		return 0
+	}
+	return value / span.Seconds()
+}
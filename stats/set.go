@@ -1,7 +1,6 @@
 package stats
 
 import (
-	"context"
 	"sync"
 
 	ocstats "go.opencensus.io/stats"
@@ -9,23 +8,30 @@ import (
 
 type Set struct {
 	sync.RWMutex
+	stats *Stats
 	name  string
-	m     map[Key]context.Context
-	cache []context.Context
+	m     map[Key]struct{}
+	cache []Key
 }
 
+// NewSet returns a set recording to the default instance.
 func NewSet(name string) *Set {
 	return &Set{
 		name: name,
-		m:    make(map[Key]context.Context),
+		m:    make(map[Key]struct{}),
 	}
 }
+
+// NewSet returns a set recording to s.
+func (s *Stats) NewSet(name string) *Set {
+	set := NewSet(name)
+	set.stats = s
+	return set
+}
 func (s *Set) updateCache() {
-	s.RLock()
-	s.RUnlock()
-	var c []context.Context
-	for _, ctx := range s.m {
-		c = append(c, ctx)
+	var c []Key
+	for key := range s.m {
+		c = append(c, key)
 	}
 	s.cache = c
 }
@@ -33,13 +39,9 @@ func (s *Set) Add(keys ...Key) *Set {
 	s.Lock()
 	defer s.Unlock()
 	for i := 0; i < len(keys); i++ {
-		s.m[keys[i]], _ = keys[i].context(context.Background())
-	}
-	var c []context.Context
-	for _, ctx := range s.m {
-		c = append(c, ctx)
+		s.m[keys[i]] = struct{}{}
 	}
-	s.cache = c
+	s.updateCache()
 	return s
 }
 
@@ -49,25 +51,42 @@ func (s *Set) Remove(keys ...Key) *Set {
 	for i := 0; i < len(keys); i++ {
 		delete(s.m, keys[i])
 	}
-	var c []context.Context
-	for _, ctx := range s.m {
-		c = append(c, ctx)
-	}
-	s.cache = c
+	s.updateCache()
 	return s
 
 }
 
+// Record records the items for every key of the set in the background. The
+// keys go through the key cache of the instance, so they count towards its
+// limits.
 func (s *Set) Record(items ...Item) error {
 
 	s.Lock()
-	var localCache []context.Context
+	var localCache []Key
 	localCache = append(localCache, s.cache...)
 	s.Unlock()
-	ms := getMeasurements(items...)
-	go func(cache []context.Context, ms []ocstats.Measurement) {
-		for _, ctx := range cache {
-			ocstats.Record(ctx, ms...)
+	st := s.stats
+	if st == nil {
+		if st = Default(); st == nil {
+			return nil
+		}
+	}
+	// the read lock is handed to the goroutine, so the measures of ms stay
+	// the current ones and Close waits for the recording
+	st.recordMu.RLock()
+	if st.closed {
+		st.recordMu.RUnlock()
+		return nil
+	}
+	st.recordings.Add(1)
+	ms := st.measurements(items...)
+	go func(keys []Key, ms []ocstats.Measurement) {
+		defer st.recordings.Done()
+		defer st.recordMu.RUnlock()
+		for _, key := range keys {
+			if ctx, err := st.ctxCache.get(key); err == nil {
+				st.recorder(ctx, ms...)
+			}
 		}
 	}(localCache, ms)
 	return nil
@@ -2,7 +2,11 @@ package stats
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.opencensus.io/exporter/prometheus"
@@ -12,17 +16,93 @@ import (
 	"go.opencensus.io/tag"
 )
 
+// Stats is an instance of the stats: its measures, views, declared tag keys,
+// key cache and exporters are its own, so several instances do not share
+// anything. Keys are recorded to an instance with its Record and NewSet
+// methods, or to the default instance, the last one returned by Init, with
+// Key.Record, NewSet and the Report helpers.
 type Stats struct {
 	opts             statsOptions
 	internalExporter *exporter
 	promExporter     *prometheus.Exporter
+	promAdapter      *promAdapter
+	statsdExporter   *statsdExporter
+	influxExporter   *influxExporter
+	graphiteExporter *graphiteExporter
+	otlpExporter     *otlpExporter
+	fileExporter     *fileExporter
+	stream           *streamBroker
+
+	id            uint64
+	intMeasures   map[statType]*ocstats.Int64Measure
+	floatMeasures map[statType]*ocstats.Float64Measure
+	// views are registered under names unique to the instance, exportViews
+	// are their copies named after the stat types which the exporters get.
+	views       map[statType]*view.View
+	exportViews map[statType]*view.View
+	tagKeys     []tag.Key
+	declared    tagKeySet
+	ctxCache    *contextCache
+	// recorder hands the measurements to the view worker, ocstats.Record
+	// but in tests.
+	recorder func(ctx context.Context, ms ...ocstats.Measurement)
+	// recordMu is held for reading while recording and for writing while
+	// retrieve reads the views, compact swaps them or Close sets closed,
+	// after which recordings are dropped.
+	recordMu sync.RWMutex
+	closed   bool
+	// gen is the generation of the current views and base the data of the
+	// keys that were not evicted in the views that compact replaced.
+	gen  int
+	base map[statType]map[Key]*view.Row
+	// recordings tracks the recordings made in the background, which Close
+	// waits for.
+	recordings sync.WaitGroup
+
+	created   time.Time
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
 }
 
+var (
+	lastID       uint64
+	defaultStats atomic.Value
+)
+
+// Init returns a new instance, like New, and makes it the default instance.
 func Init(opts ...StateOption) (*Stats, error) {
-	s := &Stats{}
+	s, err := New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	defaultStats.Store(s)
+	return s, nil
+}
+
+// Default returns the default instance, the last one returned by Init, nil
+// before the first call.
+func Default() *Stats {
+	s, _ := defaultStats.Load().(*Stats)
+	return s
+}
+
+// New returns a new instance. It exports its views every export interval to
+// its own exporters until it is closed.
+func New(opts ...StateOption) (s *Stats, err error) {
+	s = &Stats{
+		id:       atomic.AddUint64(&lastID, 1),
+		created:  time.Now(),
+		done:     make(chan struct{}),
+		recorder: ocstats.Record,
+	}
 	so := statsOptions{
 		exportInterval:         5 * time.Second,
 		enableInternalExporter: false,
+		latencyBuckets:         defaultLatencyBuckets,
+		msgSizeBuckets:         defaultMsgSizeBuckets,
+		rateSmoothing:          defaultRateSmoothing,
 	}
 	if len(opts) > 0 {
 		for _, opt := range opts {
@@ -30,34 +110,381 @@ func Init(opts ...StateOption) (*Stats, error) {
 		}
 	}
 	s.opts = so
-	var err error
+	if s.opts.maxKeys < 0 {
+		return nil, fmt.Errorf("stats: invalid max keys %d", s.opts.maxKeys)
+	}
+	if s.opts.keyTTL < 0 {
+		return nil, fmt.Errorf("stats: invalid key TTL %s", s.opts.keyTTL)
+	}
+	if err := checkBuckets(typeLatency, s.opts.latencyBuckets); err != nil {
+		return nil, err
+	}
+	if err := checkBuckets(typeMsgSizeDist, s.opts.msgSizeBuckets); err != nil {
+		return nil, err
+	}
+	if s.opts.rateSmoothing <= 0 {
+		return nil, fmt.Errorf("stats: invalid rate smoothing %s", s.opts.rateSmoothing)
+	}
+	if s.opts.exportInterval <= 0 {
+		return nil, fmt.Errorf("stats: invalid export interval %s", s.opts.exportInterval)
+	}
+	for _, w := range s.opts.windows {
+		if w <= 0 {
+			return nil, fmt.Errorf("stats: invalid window %s", w)
+		}
+	}
+	if s.declared, err = newTagKeySet(s.opts.tagKeys); err != nil {
+		return nil, err
+	}
+	tagKeys := s.declared.sorted()
+	s.ctxCache = newContextCache(s.opts.maxKeys, s.opts.keyTTL, s.declared)
+	// release what was set up when a later step fails
+	defer func() {
+		if err != nil {
+			s.release()
+			s = nil
+		}
+	}()
+	s.tagKeys = append(append([]tag.Key(nil), Keys...), tagKeys...)
+	if err = s.registerViews(0); err != nil {
+		return
+	}
 	if s.opts.enablePrometheus {
 		s.promExporter, err = prometheus.NewExporter(prometheus.Options{
 			Namespace: s.opts.namespace,
+			Registry:  s.opts.promRegistry,
 			OnError:   s.opts.errFunc,
 		})
 		if err != nil {
-			return nil, err
+			return
+		}
+		s.promAdapter, err = newPromAdapter(s.promExporter, s.opts.promConstLabels, append(append([]tag.Key(nil), Keys...), tagKeys...))
+		if err != nil {
+			return
+		}
+	}
+	if s.opts.statsd != nil {
+		if s.statsdExporter, err = newStatsDExporter(*s.opts.statsd); err != nil {
+			return
+		}
+	}
+	if s.opts.influx != nil {
+		if s.influxExporter, err = newInfluxExporter(*s.opts.influx); err != nil {
+			return
 		}
-		view.RegisterExporter(s.promExporter)
-
+	}
+	if s.opts.graphite != nil {
+		if s.graphiteExporter, err = newGraphiteExporter(*s.opts.graphite, s.declared); err != nil {
+			return
+		}
+	}
+	if s.opts.otlp != nil {
+		s.otlpExporter = newOTLPExporter(*s.opts.otlp)
 	}
 	if s.opts.enableInternalExporter {
-		s.internalExporter = NewExporter()
-		view.RegisterExporter(s.internalExporter)
+		s.internalExporter = NewExporter(s.opts.windows...)
+		s.internalExporter.aggMap.smoothing = s.opts.rateSmoothing
+		s.internalExporter.interval = s.opts.exportInterval
+		if precision := s.opts.approxPrecision; precision > 0 {
+			s.internalExporter.aggMap.newCounter = func() distinctCounter {
+				return newHyperLogLog(precision)
+			}
+		}
+		s.stream = newStreamBroker(s.internalExporter)
 	}
-	view.SetReportingPeriod(s.opts.exportInterval)
-	for _, v := range typeViews {
-		if err := view.Register(v); err != nil {
-			return nil, err
+	if s.opts.file != nil {
+		if s.fileExporter, err = newFileExporter(s, *s.opts.file); err != nil {
+			return
 		}
 	}
+	// idle keys are evicted when reporting
+	if len(s.exporters()) > 0 || s.opts.keyTTL > 0 {
+		s.wg.Add(1)
+		go s.run()
+	}
 	return s, nil
 }
 
+// run exports the views every export interval, evicting the idle keys.
+func (s *Stats) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.opts.exportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.report()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// report evicts the idle keys and exports the data of every view to the
+// exporters. Retrieving the data waits for the recordings pending in the view
+// worker. It relies on view.RetrieveData, which OpenCensus documents as meant
+// for tests, because an exporter registered with view.RegisterExporter gets
+// the views of every instance at a reporting period shared by all of them.
+func (s *Stats) report() {
+	s.evict()
+	exporters := s.exporters()
+	end := time.Now()
+	data := s.retrieve()
+	for st := typeMsgCount; st <= typeMsgSizeDist; st++ {
+		rows, ok := data[st]
+		if !ok {
+			continue
+		}
+		rows = s.withBase(st, rows)
+		if st.counter() {
+			rows = asCounts(rows)
+		}
+		vd := &view.Data{View: s.exportViews[st], Start: s.created, End: end, Rows: rows}
+		for _, e := range exporters {
+			e.ExportView(vd)
+		}
+	}
+}
+
+// retrieve returns the rows of every view. Recordings are held off meanwhile,
+// so the views have the same recordings and the measurements of an item are
+// never reported in different cycles.
+func (s *Stats) retrieve() map[statType][]*view.Row {
+	s.recordMu.Lock()
+	defer s.recordMu.Unlock()
+	data := make(map[statType][]*view.Row, len(s.views))
+	for st := typeMsgCount; st <= typeMsgSizeDist; st++ {
+		rows, err := view.RetrieveData(s.views[st].Name)
+		if err != nil {
+			if s.opts.errFunc != nil {
+				s.opts.errFunc(err)
+			}
+			continue
+		}
+		data[st] = rows
+	}
+	return data
+}
+
+// asCounts returns rows with their sums as counts.
+func asCounts(rows []*view.Row) []*view.Row {
+	counts := make([]*view.Row, len(rows))
+	for i, row := range rows {
+		counts[i] = row
+		if v, ok := row.Data.(*view.SumData); ok {
+			counts[i] = &view.Row{Tags: row.Tags, Data: &view.CountData{Value: int64(math.Round(v.Value))}}
+		}
+	}
+	return counts
+}
+
 func (s *Stats) GetMetricsMap() (map[string]*ChannelSummary, Summary) {
 	return s.internalExporter.aggMap.GetChannelSummaryMap()
 }
+
+// Cursor marks the cumulative values a consumer of Delta has already seen.
+type Cursor struct {
+	at     time.Time
+	values map[aggIndex]interface{}
+}
+
+// Time returns when the cursor was taken.
+func (c *Cursor) Time() time.Time {
+	return c.at
+}
+
+// Snapshot returns the cumulative summaries of every key seen by the internal
+// exporter. It does not change any state.
+func (s *Stats) Snapshot() (map[string]*ChannelSummary, Summary) {
+	if s.internalExporter == nil {
+		return map[string]*ChannelSummary{}, Summary{}
+	}
+	return s.internalExporter.aggMap.GetSnapshot(query{})
+}
+
+// Delta returns the summaries of what changed since the cursor returned by a
+// previous call, nil for everything, along with the cursor for the next call.
+// Each consumer keeps its own cursor so they do not affect each other.
+func (s *Stats) Delta(since *Cursor) (map[string]*ChannelSummary, Summary, *Cursor) {
+	if s.internalExporter == nil {
+		return map[string]*ChannelSummary{}, Summary{}, &Cursor{at: time.Now()}
+	}
+	return s.internalExporter.aggMap.GetDelta(since)
+}
+
+// GetWindowMetricsMap returns the summaries over the last window, which must
+// be one of the windows configured with WithWindows. Unlike GetMetricsMap it
+// does not consume anything and can be called by any number of readers.
+func (s *Stats) GetWindowMetricsMap(window time.Duration) (map[string]*ChannelSummary, Summary, error) {
+	if window <= 0 {
+		return nil, Summary{}, fmt.Errorf("stats: window %s is not configured", window)
+	}
+	return s.query(window, query{})
+}
+
+// GroupBy returns the summaries of the keys grouped by dims, which can be any
+// of Keys or the tag keys declared with WithTagKeys. Every group sums the
+// totals of its keys and recomputes the averages, ratios and percentiles. A
+// zero window groups the cumulative values, any other must be one of the
+// windows configured with WithWindows.
+func (s *Stats) GroupBy(window time.Duration, dims ...tag.Key) (map[string]*ChannelSummary, Summary, error) {
+	for _, d := range dims {
+		if _, ok := s.declared[d.Name()]; !ok && !isFieldKey(d) {
+			return nil, Summary{}, fmt.Errorf("stats: unknown dimension %q", d.Name())
+		}
+	}
+	return s.query(window, query{dims: append([]tag.Key{}, dims...)})
+}
+
+// query returns the summaries of the keys selected by q, cumulative for a zero
+// window.
+func (s *Stats) query(window time.Duration, q query) (map[string]*ChannelSummary, Summary, error) {
+	if s.internalExporter == nil {
+		return nil, Summary{}, errors.New("stats: internal exporter is not enabled")
+	}
+	aggMap := s.internalExporter.aggMap
+	if window == 0 {
+		m, sum := aggMap.GetSnapshot(q)
+		return m, sum, nil
+	}
+	for _, w := range aggMap.windows {
+		if w == window {
+			m, sum := aggMap.GetWindowSummaryMap(window, q)
+			return m, sum, nil
+		}
+	}
+	return nil, Summary{}, fmt.Errorf("stats: window %s is not configured", window)
+}
+
+// Close stops s. It waits for the recordings made in the background by
+// Set.Record and ReportMessageSubscribe, exports the views a last time to
+// every exporter and the OnInterval callbacks, unregisters the views and
+// closes the exporters, which flush what they buffered. When ctx is done
+// first, Close returns its error and the shutdown goes on in the background.
+// Only the first call does anything, the following ones return its error.
+// OpenCensus cannot remove a measure, so the measures of s stay registered
+// under their unique names for the life of the process, without any view.
+func (s *Stats) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() {
+		done := make(chan error, 1)
+		go func() {
+			done <- s.shutdown()
+		}()
+		select {
+		case s.closeErr = <-done:
+		case <-ctx.Done():
+			s.closeErr = ctx.Err()
+		}
+	})
+	return s.closeErr
+}
+
+func (s *Stats) shutdown() error {
+	s.recordMu.Lock()
+	s.closed = true
+	s.recordMu.Unlock()
+	close(s.done)
+	s.wg.Wait()
+	s.recordings.Wait()
+	s.report()
+	if s.internalExporter != nil {
+		s.internalExporter.flush()
+	}
+	return s.release()
+}
+
+// addRecording adds a background recording for Close to wait for, and
+// reports false when s is closed.
+func (s *Stats) addRecording() bool {
+	s.recordMu.RLock()
+	defer s.recordMu.RUnlock()
+	if s.closed {
+		return false
+	}
+	s.recordings.Add(1)
+	return true
+}
+
+// release unregisters the views and closes the exporters.
+func (s *Stats) release() error {
+	for _, v := range s.views {
+		view.Unregister(v)
+	}
+	var errs []error
+	if s.statsdExporter != nil {
+		errs = append(errs, s.statsdExporter.close())
+	}
+	if s.influxExporter != nil {
+		errs = append(errs, s.influxExporter.close())
+	}
+	if s.graphiteExporter != nil {
+		errs = append(errs, s.graphiteExporter.close())
+	}
+	if s.otlpExporter != nil {
+		s.otlpExporter.close()
+	}
+	if s.fileExporter != nil {
+		s.fileExporter.close()
+	}
+	if s.stream != nil {
+		s.stream.close()
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exporters returns the exporters of s, the internal exporter first.
+func (s *Stats) exporters() []view.Exporter {
+	var exporters []view.Exporter
+	if s.internalExporter != nil {
+		exporters = append(exporters, s.internalExporter)
+	}
+	if s.promAdapter != nil {
+		exporters = append(exporters, s.promAdapter)
+	}
+	if s.statsdExporter != nil {
+		exporters = append(exporters, s.statsdExporter)
+	}
+	if s.influxExporter != nil {
+		exporters = append(exporters, s.influxExporter)
+	}
+	if s.graphiteExporter != nil {
+		exporters = append(exporters, s.graphiteExporter)
+	}
+	if s.otlpExporter != nil {
+		exporters = append(exporters, s.otlpExporter)
+	}
+	return exporters
+}
+
+// OnInterval registers f to be called once every export interval, after the
+// internal exporter received all the views of the interval, with the
+// summaries of the keys that changed during it. The callbacks are called in
+// order by the goroutine exporting the views and must return quickly; the map
+// is shared between them and must not be modified.
+func (s *Stats) OnInterval(f func(map[string]*ChannelSummary, Summary)) error {
+	if s.internalExporter == nil {
+		return errors.New("stats: internal exporter is not enabled")
+	}
+	s.internalExporter.onInterval(f)
+	return nil
+}
+
+// InfluxCounters returns the counters of the InfluxDB exporter, zero when it
+// is not enabled.
+func (s *Stats) InfluxCounters() InfluxCounters {
+	if s.influxExporter == nil {
+		return InfluxCounters{}
+	}
+	return s.influxExporter.counters()
+}
+
+// GetPrometheusHandler returns the http.Handler serving the views in the
+// Prometheus format, nil unless enabled with WithPrometheus.
 func (s *Stats) GetPrometheusHandler() *prometheus.Exporter {
 	return s.promExporter
 }
@@ -72,41 +499,57 @@ const (
 	typeErrors
 	typeLatency
 	typeLastUpdate
+	typeMsgSizeDist
 )
 
 func (t statType) String() string {
 	return typeNames[t]
 }
 
-func (t statType) Stat() ocstats.Measure {
-	return typeIntMeasures[t]
+// counter reports whether t counts events. Counters are recorded as the value
+// of their count and summed by their views, and are exported as counts.
+func (t statType) counter() bool {
+	return t == typeCacheHits || t == typeCacheMiss || t == typeErrors
 }
 
-func (t statType) View() *view.View {
-	return typeViews[t]
+func statTypeOf(name string) (statType, bool) {
+	for t, n := range typeNames {
+		if n == name {
+			return t, true
+		}
+	}
+	return 0, false
 }
 
 var typeNames = map[statType]string{
-	typeMsgCount:   "total_messages",
-	typeMsgSize:    "total_message_size",
-	typeCacheHits:  "total_cache_hits",
-	typeCacheMiss:  "total_cache_miss",
-	typeErrors:     "total_errors",
-	typeLatency:    "total_latency",
-	typeLastUpdate: "LastUpdatedUnix",
+	typeMsgCount:    "total_messages",
+	typeMsgSize:     "total_message_size",
+	typeCacheHits:   "total_cache_hits",
+	typeCacheMiss:   "total_cache_miss",
+	typeErrors:      "total_errors",
+	typeLatency:     "total_latency",
+	typeLastUpdate:  "LastUpdatedUnix",
+	typeMsgSizeDist: "message_size_distribution",
 }
 
-var typeIntMeasures = map[statType]*ocstats.Int64Measure{
-	typeCacheHits:  ocstats.Int64("total_cache_hits", "count the number of requests with cache hits", "1"),
-	typeCacheMiss:  ocstats.Int64("total_cache_miss", "count the number of requests with cache miss", "1"),
-	typeErrors:     ocstats.Int64("total_errors", "count the number of errors", "1"),
-	typeLastUpdate: ocstats.Int64("LastUpdatedUnix", "unix time of current update", "ns"),
+// measureDescriptions holds the description and unit of the measure of every
+// stat type but typeMsgSizeDist, which reuses the measure of typeMsgSize.
+var measureDescriptions = map[statType][2]string{
+	typeCacheHits:  {"count the number of requests with cache hits", "1"},
+	typeCacheMiss:  {"count the number of requests with cache miss", "1"},
+	typeErrors:     {"count the number of errors", "1"},
+	typeLastUpdate: {"unix time of current update", "ns"},
+	typeMsgSize:    {"sum the size of messages", "by"},
+	typeLatency:    {"distribution of requests latency", "ms"},
+	typeMsgCount:   {"count the number of messages", "1"},
 }
 
-var typeFloatMeasures = map[statType]*ocstats.Float64Measure{
-	typeMsgSize:  ocstats.Float64("total_message_size", "sum the size of messages", "by"),
-	typeLatency:  ocstats.Float64("total_latency", "distribution of requests latency", "ms"),
-	typeMsgCount: ocstats.Float64("total_messages", "count the number of messages", "1"),
+// uniqueName returns the name of the measure or view of st of the instance
+// for the generation gen, 0 or 1, see compact. Measures and views are
+// registered by name for the whole process, so every instance suffixes them
+// with its id.
+func (s *Stats) uniqueName(st statType, gen int) string {
+	return fmt.Sprintf("%s.%d.%d", st, s.id, gen)
 }
 
 var (
@@ -121,67 +564,66 @@ var (
 	Keys = []tag.Key{KeyNode, KeyClientID, KeyChannel, KeyGroup, KeyKind, KeySubKind}
 )
 
-var typeViews = map[statType]*view.View{
-	typeMsgCount: &view.View{
-		TagKeys:     Keys,
-		Measure:     typeFloatMeasures[typeMsgCount],
-		Aggregation: view.Sum(),
-	},
-	typeMsgSize: &view.View{
-		TagKeys:     Keys,
-		Measure:     typeFloatMeasures[typeMsgSize],
-		Aggregation: view.Sum(),
-	},
-	typeCacheHits: &view.View{
-		TagKeys:     Keys,
-		Measure:     typeIntMeasures[typeCacheHits],
-		Aggregation: view.Count(),
-	},
-	typeCacheMiss: &view.View{
-		TagKeys:     Keys,
-		Measure:     typeIntMeasures[typeCacheMiss],
-		Aggregation: view.Count(),
-	},
-	typeErrors: &view.View{
-		TagKeys:     Keys,
-		Measure:     typeIntMeasures[typeErrors],
-		Aggregation: view.Count(),
-	},
-	typeLatency: &view.View{
-		TagKeys:     Keys,
-		Measure:     typeFloatMeasures[typeLatency],
-		Aggregation: view.Distribution(0, 25, 50, 75, 100, 200, 400, 600, 800, 1000, 2000, 4000, 6000),
-	},
-	typeLastUpdate: &view.View{
-		TagKeys:     Keys,
-		Measure:     typeIntMeasures[typeLastUpdate],
-		Aggregation: view.LastValue(),
-	},
-}
-
-type contextCache struct {
-	sync.RWMutex
-	m map[Key]context.Context
-}
-
-func newContextCache() *contextCache {
-	return &contextCache{
-		m: map[Key]context.Context{},
-	}
-}
-func (cc *contextCache) get(key Key) (context.Context, error) {
-	cc.Lock()
-	defer cc.Unlock()
-	ctx, ok := cc.m[key]
-	if ok {
-		return ctx, nil
-	}
-	ctx, err := key.context(context.Background())
-	if err != nil {
-		return context.TODO(), err
+func typeView(st statType, name string, tagKeys []tag.Key, ints map[statType]*ocstats.Int64Measure, floats map[statType]*ocstats.Float64Measure, o statsOptions) *view.View {
+	v := &view.View{
+		Name:    name,
+		TagKeys: append([]tag.Key(nil), tagKeys...),
+	}
+	switch st {
+	case typeMsgCount, typeMsgSize:
+		v.Measure = floats[st]
+		v.Aggregation = view.Sum()
+	case typeCacheHits, typeCacheMiss, typeErrors:
+		v.Measure = ints[st]
+		v.Aggregation = view.Sum()
+	case typeLatency:
+		v.Measure = floats[st]
+		v.Aggregation = view.Distribution(o.latencyBuckets...)
+	case typeLastUpdate:
+		v.Measure = ints[st]
+		v.Aggregation = view.LastValue()
+	case typeMsgSizeDist:
+		v.Measure = floats[typeMsgSize]
+		v.Aggregation = view.Distribution(o.msgSizeBuckets...)
 	}
-	cc.m[key] = ctx
-	return ctx, nil
+	return v
 }
 
-var ctxCache = newContextCache()
+// registerViews creates the measures and registers the views of the
+// generation gen, which become the current ones.
+func (s *Stats) registerViews(gen int) error {
+	ints := make(map[statType]*ocstats.Int64Measure)
+	floats := make(map[statType]*ocstats.Float64Measure)
+	for st, d := range measureDescriptions {
+		switch st {
+		case typeCacheHits, typeCacheMiss, typeErrors, typeLastUpdate:
+			ints[st] = ocstats.Int64(s.uniqueName(st, gen), d[0], d[1])
+		default:
+			floats[st] = ocstats.Float64(s.uniqueName(st, gen), d[0], d[1])
+		}
+	}
+	views := make(map[statType]*view.View)
+	for st := range typeNames {
+		v := typeView(st, s.uniqueName(st, gen), s.tagKeys, ints, floats, s.opts)
+		if err := view.Register(v); err != nil {
+			for _, registered := range views {
+				view.Unregister(registered)
+			}
+			return err
+		}
+		views[st] = v
+	}
+	s.intMeasures, s.floatMeasures, s.views, s.gen = ints, floats, views, gen
+	if s.exportViews == nil {
+		s.exportViews = make(map[statType]*view.View)
+		for st, v := range views {
+			ev := *v
+			ev.Name = st.String()
+			if st.counter() {
+				ev.Aggregation = view.Count()
+			}
+			s.exportViews[st] = &ev
+		}
+	}
+	return nil
+}
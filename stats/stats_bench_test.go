@@ -3,6 +3,7 @@ package stats
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -86,7 +87,7 @@ func Benchmark_Key_Insert(b *testing.B) {
 
 			b.ResetTimer()
 			for i := 0; i < b.N; i++ {
-				key.context(context.Background())
+				key.context(context.Background(), nil)
 			}
 		})
 		b.Run("get_key"+bm.name, func(b *testing.B) {
@@ -145,3 +146,79 @@ func Benchmark_Helpers(b *testing.B) {
 
 	}
 }
+
+func Benchmark_Key_RecordParallel(b *testing.B) {
+	Init(WithExportInterval(10000*time.Millisecond), WithInternalExporter())
+	item := Item{MsgCount: 1, MsgSize: 200}
+
+	b.Run("same_key", func(b *testing.B) {
+		key := GetKey("some_node", "client_id", "some_channel", "some_group", "some_kind", "sub_kind")
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				key.Record(item)
+			}
+		})
+	})
+	b.Run("key_per_goroutine", func(b *testing.B) {
+		var n int64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			key := GetKey("some_node", fmt.Sprintf("client_id_%d", atomic.AddInt64(&n, 1)), "some_channel", "", "", "")
+			for pb.Next() {
+				key.Record(item)
+			}
+		})
+	})
+	b.Run("context_cache_hit", func(b *testing.B) {
+		cc := newContextCache(0, time.Minute, nil)
+		var n int64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			key := GetKey("some_node", fmt.Sprintf("client_id_%d", atomic.AddInt64(&n, 1)), "some_channel", "", "", "")
+			for pb.Next() {
+				cc.get(key)
+			}
+		})
+	})
+}
+
+// Benchmark_Key_RecordAllocs shows that building the measurements and getting
+// the context of a cached key do not allocate. Record still allocates the
+// measurements it hands to the view worker, which reads them after Record
+// returns, and ocstats.Record its request; the allocations of the worker
+// encoding the tags of every sample are counted too.
+func Benchmark_Key_RecordAllocs(b *testing.B) {
+	s, err := New()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close(context.Background())
+	item := Item{MsgCount: 1, MsgSize: 200, CacheHit: 1, Errors: 1000, Latency: 1000}
+	key := GetKey("some_node", "client_id", "some_channel", "some_group", "some_kind", "sub_kind")
+
+	b.Run("append_measurements", func(b *testing.B) {
+		ms := s.appendMeasurements(nil, item)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			ms = s.appendMeasurements(ms[:0], item)
+		}
+	})
+	b.Run("context_cache_hit", func(b *testing.B) {
+		s.ctxCache.get(key)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.ctxCache.get(key)
+		}
+	})
+	b.Run("record_cached_key", func(b *testing.B) {
+		s.Record(key, item)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.Record(key, item)
+		}
+	})
+}
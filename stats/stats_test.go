@@ -1,26 +1,44 @@
 package stats
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	ocstats "go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
 
 	"github.com/stretchr/testify/require"
 )
 
+// createResultMetric returns base with the key fields of key.
 func createResultMetric(key Key, base *ChannelSummary) *ChannelSummary {
-	m := NewChannelSummary(key)
-	m.TotalCacheHits = base.TotalCacheHits
-	m.TotalMsgCount = base.TotalMsgCount
-	m.TotalMsgSize = base.TotalMsgSize
-	m.LastUpdatedUnix = base.LastUpdatedUnix
-	m.AvgLatency = base.AvgLatency
-	m.TotalErrors = base.TotalErrors
-	m.TotalCacheMiss = base.TotalCacheMiss
-	return m
+	m := *base
+	k := NewChannelSummary(key)
+	m.Node, m.Channel, m.Group, m.ClientID, m.Kind, m.Labels = k.Node, k.Channel, k.Group, k.ClientID, k.Kind, k.Labels
+	return &m
 }
+
+// clearRates zeroes the rates of m, which depend on timing, after checking
+// they are set whenever there is something to rate.
+func clearRates(t *testing.T, m *ChannelSummary) {
+	assert.Equal(t, m.TotalMsgCount > 0, m.MsgRate > 0)
+	assert.Equal(t, m.TotalMsgSize > 0, m.ByteRate > 0)
+	assert.Equal(t, m.TotalErrors > 0, m.ErrorsPerSec > 0)
+	m.MsgRate, m.ByteRate, m.ErrorsPerSec = 0, 0, 0
+	m.MsgRateEWMA, m.ByteRateEWMA, m.ErrorsPerSecEWMA = 0, 0, 0
+}
+
 func TestKey_SingleKeySingleItem(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -81,6 +99,11 @@ func TestKey_SingleKeySingleItem(t *testing.T) {
 				TotalMsgCount:   0,
 				TotalMsgSize:    100,
 				AvgMsgSize:      0,
+				MaxMsgSize:      100,
+				MsgSizeP50:      100,
+				MsgSizeP90:      100,
+				MsgSizeP95:      100,
+				MsgSizeP99:      100,
 				TotalCacheHits:  0,
 				TotalCacheMiss:  0,
 				CacheHitsRatio:  0,
@@ -142,7 +165,7 @@ func TestKey_SingleKeySingleItem(t *testing.T) {
 				Group:           "q1",
 				ClientID:        "client_2",
 				Kind:            "publish_subscribe",
-				TotalMsgCount:   8,
+				TotalMsgCount:   0,
 				TotalMsgSize:    0,
 				AvgMsgSize:      0,
 				TotalCacheHits:  2,
@@ -150,10 +173,16 @@ func TestKey_SingleKeySingleItem(t *testing.T) {
 				CacheHitsRatio:  0.4,
 				TotalErrors:     4,
 				AvgLatency:      2,
-				SuccessRate:     50,
-				ErrorRate:       50,
+				MinLatency:      2,
+				MaxLatency:      2,
+				LatencyP50:      2,
+				LatencyP90:      2,
+				LatencyP95:      2,
+				LatencyP99:      2,
+				SuccessRate:     100,
+				ErrorRate:       0,
 				LastUpdatedUnix: 1000,
-				LastUpdateTime:  time.Time{},
+				LastUpdateTime:  time.Unix(1000, 0),
 			},
 		},
 	}
@@ -165,8 +194,9 @@ func TestKey_SingleKeySingleItem(t *testing.T) {
 			require.NoError(t, err)
 			time.Sleep(100 * time.Millisecond)
 			resultMap, _ := s.GetMetricsMap()
-			metric, ok := resultMap[string(test.key)]
+			metric, ok := resultMap[test.key.String()]
 			require.True(t, ok)
+			clearRates(t, metric)
 			assert.EqualValues(t, test.expected, metric)
 			resultMap, _ = s.GetMetricsMap()
 			require.Zero(t, len(resultMap))
@@ -213,11 +243,27 @@ func TestKey_SingleKeyMultiItems(t *testing.T) {
 				Kind:            "publish",
 				TotalMsgCount:   4,
 				TotalMsgSize:    200,
+				AvgMsgSize:      50,
+				MaxMsgSize:      150,
+				MsgSizeP50:      64,
+				MsgSizeP90:      132.8,
+				MsgSizeP95:      141.39999999999998,
+				MsgSizeP99:      148.28,
 				TotalCacheHits:  5,
 				TotalCacheMiss:  5,
+				CacheHitsRatio:  0.5,
 				TotalErrors:     3,
 				AvgLatency:      2.5,
+				MinLatency:      2,
+				MaxLatency:      3,
+				LatencyP50:      2.5,
+				LatencyP90:      2.9,
+				LatencyP95:      2.95,
+				LatencyP99:      2.99,
+				SuccessRate:     25,
+				ErrorRate:       75,
 				LastUpdatedUnix: 10000,
+				LastUpdateTime:  time.Unix(10000, 0),
 			},
 			expSummary: Summary{
 				Node:                "node_1",
@@ -230,8 +276,21 @@ func TestKey_SingleKeyMultiItems(t *testing.T) {
 				TotalErrors:         3,
 				TotalActiveChannels: 1,
 				TotalActiveClients:  1,
-				SuccessRate:         3 / 4,
-				ErrorRate:           100 - (3 / 4),
+				TotalActiveNodes:    1,
+				SuccessRate:         25,
+				ErrorRate:           75,
+				AvgLatency:          2.5,
+				MinLatency:          2,
+				MaxLatency:          3,
+				LatencyP50:          2.5,
+				LatencyP90:          2.9,
+				LatencyP95:          2.95,
+				LatencyP99:          2.99,
+				MaxMsgSize:          150,
+				MsgSizeP50:          64,
+				MsgSizeP90:          132.8,
+				MsgSizeP95:          141.39999999999998,
+				MsgSizeP99:          148.28,
 			},
 		},
 	}
@@ -243,9 +302,12 @@ func TestKey_SingleKeyMultiItems(t *testing.T) {
 			require.NoError(t, err)
 			time.Sleep(100 * time.Millisecond)
 			resultMap, sum := s.GetMetricsMap()
-			metric, ok := resultMap[string(test.key)]
+			metric, ok := resultMap[test.key.String()]
 			require.True(t, ok)
+			clearRates(t, metric)
 			assert.EqualValues(t, test.expChannelSummary, metric)
+			sum.MsgRate, sum.ByteRate, sum.ErrorsPerSec = 0, 0, 0
+			sum.MsgRateEWMA, sum.ByteRateEWMA, sum.ErrorsPerSecEWMA = 0, 0, 0
 			assert.EqualValues(t, test.expSummary, sum)
 			resultMap, _ = s.GetMetricsMap()
 			require.Zero(t, len(resultMap))
@@ -302,29 +364,77 @@ func TestKey_SingleSetSingleItem(t *testing.T) {
 				&ChannelSummary{
 					TotalMsgCount:   2,
 					TotalMsgSize:    100.0,
+					AvgMsgSize:      50,
+					MaxMsgSize:      100,
+					MsgSizeP50:      100,
+					MsgSizeP90:      100,
+					MsgSizeP95:      100,
+					MsgSizeP99:      100,
 					TotalCacheHits:  2,
 					TotalCacheMiss:  3,
+					CacheHitsRatio:  0.4,
 					TotalErrors:     4,
 					AvgLatency:      10000,
+					MinLatency:      10000,
+					MaxLatency:      10000,
+					LatencyP50:      10000,
+					LatencyP90:      10000,
+					LatencyP95:      10000,
+					LatencyP99:      10000,
+					SuccessRate:     -100,
+					ErrorRate:       200,
 					LastUpdatedUnix: 10000,
+					LastUpdateTime:  time.Unix(10000, 0),
 				},
 				&ChannelSummary{
 					TotalMsgCount:   3,
 					TotalMsgSize:    200.0,
+					AvgMsgSize:      200.0 / 3,
+					MaxMsgSize:      200,
+					MsgSizeP50:      150,
+					MsgSizeP90:      190,
+					MsgSizeP95:      195,
+					MsgSizeP99:      199,
 					TotalCacheHits:  4,
 					TotalCacheMiss:  5,
+					CacheHitsRatio:  4.0 / 9,
 					TotalErrors:     6,
 					AvgLatency:      1000,
+					MinLatency:      1000,
+					MaxLatency:      2000,
+					LatencyP50:      1500,
+					LatencyP90:      1900,
+					LatencyP95:      1950,
+					LatencyP99:      1990,
+					SuccessRate:     -100,
+					ErrorRate:       200,
 					LastUpdatedUnix: 11000,
+					LastUpdateTime:  time.Unix(11000, 0),
 				},
 				&ChannelSummary{
 					TotalMsgCount:   3,
 					TotalMsgSize:    200.0,
+					AvgMsgSize:      200.0 / 3,
+					MaxMsgSize:      200,
+					MsgSizeP50:      150,
+					MsgSizeP90:      190,
+					MsgSizeP95:      195,
+					MsgSizeP99:      199,
 					TotalCacheHits:  4,
 					TotalCacheMiss:  5,
+					CacheHitsRatio:  4.0 / 9,
 					TotalErrors:     6,
 					AvgLatency:      1000,
+					MinLatency:      1000,
+					MaxLatency:      2000,
+					LatencyP50:      1500,
+					LatencyP90:      1900,
+					LatencyP95:      1950,
+					LatencyP99:      1990,
+					SuccessRate:     -100,
+					ErrorRate:       200,
 					LastUpdatedUnix: 12000,
+					LastUpdateTime:  time.Unix(12000, 0),
 				},
 			},
 		},
@@ -342,8 +452,9 @@ func TestKey_SingleSetSingleItem(t *testing.T) {
 			//			require.Equal(t, len(test.keys), len(resultMap))
 			for _, key := range test.keys {
 				expectedMetric := createResultMetric(key, test.expected[0])
-				resultMetric, ok := resultMap[string(key)]
+				resultMetric, ok := resultMap[key.String()]
 				require.True(t, ok)
+				clearRates(t, resultMetric)
 				assert.EqualValues(t, expectedMetric, resultMetric)
 			}
 			err = set.Record(test.item[1])
@@ -353,8 +464,9 @@ func TestKey_SingleSetSingleItem(t *testing.T) {
 			require.Equal(t, len(test.keys), len(resultMap))
 			for _, key := range test.keys {
 				expectedMetric := createResultMetric(key, test.expected[1])
-				resultMetric, ok := resultMap[string(key)]
+				resultMetric, ok := resultMap[key.String()]
 				require.True(t, ok)
+				clearRates(t, resultMetric)
 				assert.EqualValues(t, expectedMetric, resultMetric)
 			}
 			fmt.Println("remove")
@@ -366,10 +478,632 @@ func TestKey_SingleSetSingleItem(t *testing.T) {
 			require.Equal(t, len(test.keys)-1, len(resultMap))
 			for i := 1; i < len(test.keys); i++ {
 				expectedMetric := createResultMetric(test.keys[i], test.expected[2])
-				resultMetric, ok := resultMap[string(test.keys[i])]
+				resultMetric, ok := resultMap[test.keys[i].String()]
 				require.True(t, ok)
+				clearRates(t, resultMetric)
 				assert.EqualValues(t, expectedMetric, resultMetric)
 			}
 		})
 	}
 }
+
+func TestKey_LatencyPercentiles(t *testing.T) {
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter())
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	s.GetMetricsMap()
+	key := GetKey("node_percentiles", "client_percentiles", "some_channel", "", "publish", "")
+	var items []Item
+	for i := 0; i < 90; i++ {
+		items = append(items, Item{Latency: 10 * time.Millisecond})
+	}
+	for i := 0; i < 10; i++ {
+		items = append(items, Item{Latency: 500 * time.Millisecond})
+	}
+	require.NoError(t, key.Record(items...))
+	time.Sleep(100 * time.Millisecond)
+	resultMap, sum := s.GetMetricsMap()
+	metric, ok := resultMap[key.String()]
+	require.True(t, ok)
+	assert.InDelta(t, 59, metric.AvgLatency, 0.001)
+	assert.EqualValues(t, 10, metric.MinLatency)
+	assert.EqualValues(t, 500, metric.MaxLatency)
+	assert.InDelta(t, 10+15*50.0/90, metric.LatencyP50, 0.001)
+	assert.InDelta(t, 400+100*5.0/10, metric.LatencyP95, 0.001)
+	assert.InDelta(t, 400+100*9.0/10, metric.LatencyP99, 0.001)
+	assert.InDelta(t, metric.LatencyP99, sum.LatencyP99, 0.001)
+
+	require.NoError(t, key.Record(Item{Latency: 30 * time.Millisecond}, Item{Latency: 40 * time.Millisecond}))
+	time.Sleep(100 * time.Millisecond)
+	resultMap, _ = s.GetMetricsMap()
+	metric, ok = resultMap[key.String()]
+	require.True(t, ok)
+	assert.InDelta(t, 35, metric.AvgLatency, 0.001)
+	assert.EqualValues(t, 25, metric.MinLatency)
+	assert.EqualValues(t, 50, metric.MaxLatency)
+	assert.InDelta(t, 37.5, metric.LatencyP50, 0.001)
+}
+
+func TestInit_LatencyBuckets(t *testing.T) {
+	assert.Equal(t, []float64{1, 2, 4, 8}, ExponentialBuckets(1, 2, 4))
+	assert.Equal(t, []float64{0, 0.5, 1}, LinearBuckets(0, 0.5, 3))
+	_, err := Init(WithLatencyBuckets(1, 1, 2))
+	require.Error(t, err)
+
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter(), WithLatencyBuckets(LinearBuckets(0, 0.5, 10)...))
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+	assert.Equal(t, LinearBuckets(0, 0.5, 10), s.views[typeLatency].Aggregation.Buckets)
+	key := GetKey("node_buckets", "client_buckets", "some_channel", "", "publish", "")
+	require.NoError(t, key.Record(Item{Latency: 200 * time.Microsecond}, Item{Latency: 700 * time.Microsecond}))
+	time.Sleep(100 * time.Millisecond)
+	resultMap, _ := s.GetMetricsMap()
+	metric, ok := resultMap[key.String()]
+	require.True(t, ok)
+	assert.InDelta(t, 0.2, metric.MinLatency, 0.001)
+	assert.InDelta(t, 0.7, metric.MaxLatency, 0.001)
+	assert.InDelta(t, 0.5, metric.LatencyP50, 0.001)
+}
+
+func TestKey_MsgSizeDistribution(t *testing.T) {
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter(), WithMsgSizeBuckets(0, 100, 1000, 10000))
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+	time.Sleep(50 * time.Millisecond)
+	s.GetMetricsMap()
+	key := GetKey("node_sizes", "client_sizes", "some_channel", "", "publish", "")
+	other := GetKey("node_sizes", "client_sizes_2", "some_channel", "", "publish", "")
+	var items []Item
+	for i := 0; i < 8; i++ {
+		items = append(items, Item{MsgCount: 1, MsgSize: 50})
+	}
+	items = append(items, Item{MsgCount: 1, MsgSize: 5000}, Item{MsgCount: 1, MsgSize: 9000})
+	require.NoError(t, key.Record(items...))
+	require.NoError(t, other.Record(Item{MsgCount: 1, MsgSize: 500}))
+	time.Sleep(100 * time.Millisecond)
+	resultMap, sum := s.GetMetricsMap()
+	metric, ok := resultMap[key.String()]
+	require.True(t, ok)
+	assert.EqualValues(t, 1440, metric.AvgMsgSize)
+	assert.EqualValues(t, 9000, metric.MaxMsgSize)
+	assert.InDelta(t, 50+50*5.0/8, metric.MsgSizeP50, 0.001)
+	assert.InDelta(t, 1000+8000*0.5, metric.MsgSizeP90, 0.001)
+	assert.InDelta(t, 1000+8000*0.95, metric.MsgSizeP99, 0.001)
+	assert.EqualValues(t, 9000, sum.MaxMsgSize)
+	assert.InDelta(t, 50+50*5.5/8, sum.MsgSizeP50, 0.001)
+	assert.InDelta(t, 1000+8000*0.45, sum.MsgSizeP90, 0.001)
+}
+
+func TestKey_ParseKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  Key
+	}{
+		{
+			name: "empty",
+			key:  GetKey("", "", "", "", "", ""),
+		},
+		{
+			name: "plain",
+			key:  GetKey("node_1", "client_1", "some_channel", "q1", "publish", "subscribe"),
+		},
+		{
+			name: "separator_in_fields",
+			key:  GetKey("node<|>1", "client\\", "some_channel_*,|,>%$#*Q1", "<|><|>", "\\|", "<"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := ParseKey(test.key.String())
+			require.NoError(t, err)
+			assert.Equal(t, test.key, key)
+			_, err = key.context(context.Background(), nil)
+			require.NoError(t, err)
+		})
+	}
+	key := GetKey("node<|>1", "client_1", "some_channel", "", "", "")
+	assert.Equal(t, "node<|>1", key.Node())
+	assert.Equal(t, "client_1", key.ClientID())
+
+	_, err := ParseKey("node<|>client")
+	assert.Error(t, err)
+	_, err = ParseKey("node<|>client<|>channel<|>group<|>kind<|>sub_kind\\")
+	assert.Error(t, err)
+	_, err = ParseKey("node<|>client<|>chan\nnel<|>group<|>kind<|>sub_kind")
+	assert.Error(t, err)
+	assert.Error(t, GetKey("node", "client", "chan\tnel", "", "", "").Validate())
+}
+
+func TestKey_CustomTagKeys(t *testing.T) {
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter(), WithTagKeys("tenant", "region"))
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+	_, err = Init(WithTagKeys("node"))
+	require.Error(t, err)
+	// the tag keys of another instance do not change the ones of s
+	other, err := New(WithTagKeys("protocol"))
+	require.NoError(t, err)
+	defer other.Close(context.Background())
+
+	key := GetKey("node_labels", "client_labels", "some_channel", "", "publish", "", Label{Name: "tenant", Value: "acme"})
+	key = key.WithLabels(Label{Name: "region", Value: "eu<|>west"})
+	assert.Equal(t, "eu<|>west", key.Label("region"))
+	parsed, err := ParseKey(key.String())
+	require.NoError(t, err)
+	assert.Equal(t, key, parsed)
+
+	require.NoError(t, key.Record(Item{MsgCount: 2, MsgSize: 10}))
+	require.Error(t, key.WithLabels(Label{Name: "protocol", Value: "grpc"}).Record(Item{MsgCount: 1}))
+	require.NoError(t, other.Record(GetKey("node_labels", "", "", "", "", "", Label{Name: "protocol", Value: "grpc"}), Item{MsgCount: 1}))
+	require.Error(t, other.Record(key, Item{MsgCount: 1}))
+	time.Sleep(100 * time.Millisecond)
+	resultMap, _ := s.GetMetricsMap()
+	metric, ok := resultMap[key.String()]
+	require.True(t, ok)
+	assert.EqualValues(t, 2, metric.TotalMsgCount)
+	assert.Equal(t, map[string]string{"tenant": "acme", "region": "eu<|>west"}, metric.Labels)
+}
+
+func TestStats_GetWindowMetricsMap(t *testing.T) {
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter(), WithWindows(200*time.Millisecond, time.Second))
+	require.NoError(t, err)
+	_, _, err = s.GetWindowMetricsMap(time.Minute)
+	require.Error(t, err)
+
+	key := GetKey("node_windows", "client_windows", "some_channel", "", "publish", "")
+	require.NoError(t, key.Record(Item{MsgCount: 1, MsgSize: 10, Latency: 10 * time.Millisecond}))
+	time.Sleep(300 * time.Millisecond)
+	require.NoError(t, key.Record(Item{MsgCount: 2, MsgSize: 40, Latency: 30 * time.Millisecond}))
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		resultMap, _, err := s.GetWindowMetricsMap(200 * time.Millisecond)
+		require.NoError(t, err)
+		metric, ok := resultMap[key.String()]
+		require.True(t, ok)
+		assert.EqualValues(t, 2, metric.TotalMsgCount)
+		assert.EqualValues(t, 20, metric.AvgMsgSize)
+		assert.EqualValues(t, 30, metric.MaxLatency)
+
+		resultMap, _, err = s.GetWindowMetricsMap(time.Second)
+		require.NoError(t, err)
+		metric, ok = resultMap[key.String()]
+		require.True(t, ok)
+		assert.EqualValues(t, 3, metric.TotalMsgCount)
+		assert.EqualValues(t, 50, metric.TotalMsgSize)
+		assert.EqualValues(t, 10, metric.MinLatency)
+	}
+	resultMap, _ := s.GetMetricsMap()
+	metric, ok := resultMap[key.String()]
+	require.True(t, ok)
+	assert.EqualValues(t, 3, metric.TotalMsgCount)
+
+	time.Sleep(250 * time.Millisecond)
+	resultMap, _, err = s.GetWindowMetricsMap(200 * time.Millisecond)
+	require.NoError(t, err)
+	_, ok = resultMap[key.String()]
+	assert.False(t, ok)
+}
+
+func TestStats_SnapshotAndDelta(t *testing.T) {
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter())
+	require.NoError(t, err)
+	key := GetKey("node_delta", "client_delta", "some_channel", "", "publish", "")
+
+	require.NoError(t, key.Record(Item{MsgCount: 1, Errors: 1}))
+	time.Sleep(100 * time.Millisecond)
+	resultMap, _, first := s.Delta(nil)
+	require.EqualValues(t, 1, resultMap[key.String()].TotalMsgCount)
+
+	require.NoError(t, key.Record(Item{MsgCount: 2, CacheHit: 1}))
+	time.Sleep(100 * time.Millisecond)
+	resultMap, _, second := s.Delta(nil)
+	require.EqualValues(t, 3, resultMap[key.String()].TotalMsgCount)
+
+	resultMap, _, first = s.Delta(first)
+	metric, ok := resultMap[key.String()]
+	require.True(t, ok)
+	assert.EqualValues(t, 2, metric.TotalMsgCount)
+	assert.EqualValues(t, 0, metric.TotalErrors)
+	assert.EqualValues(t, 1, metric.TotalCacheHits)
+
+	resultMap, _, _ = s.Delta(first)
+	_, ok = resultMap[key.String()]
+	assert.False(t, ok)
+	resultMap, _, _ = s.Delta(second)
+	_, ok = resultMap[key.String()]
+	assert.False(t, ok)
+
+	for i := 0; i < 2; i++ {
+		resultMap, _ = s.Snapshot()
+		metric, ok = resultMap[key.String()]
+		require.True(t, ok)
+		assert.EqualValues(t, 3, metric.TotalMsgCount)
+		assert.EqualValues(t, 1, metric.TotalErrors)
+	}
+}
+
+func TestStats_Rates(t *testing.T) {
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter(), WithWindows(time.Second), WithRateSmoothing(50*time.Millisecond))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	s.GetMetricsMap()
+	key := GetKey("node_rates", "client_rates", "some_channel", "", "publish", "")
+	require.NoError(t, key.Record(Item{MsgCount: 10, MsgSize: 1000, Errors: 2}))
+	time.Sleep(30 * time.Millisecond)
+
+	resultMap, sum, err := s.GetWindowMetricsMap(time.Second)
+	require.NoError(t, err)
+	metric, ok := resultMap[key.String()]
+	require.True(t, ok)
+	assert.EqualValues(t, 10, metric.MsgRate)
+	assert.EqualValues(t, 1000, metric.ByteRate)
+	assert.EqualValues(t, 2, metric.ErrorsPerSec)
+	assert.True(t, metric.MsgRateEWMA > 0)
+	peak := metric.MsgRateEWMA
+	assert.True(t, metric.ByteRateEWMA > 0)
+	assert.True(t, metric.ErrorsPerSecEWMA > 0)
+	assert.True(t, sum.MsgRate >= metric.MsgRate)
+
+	resultMap, _ = s.GetMetricsMap()
+	metric, ok = resultMap[key.String()]
+	require.True(t, ok)
+	assert.InDelta(t, 10/0.03, metric.MsgRate, 10/0.03*0.5)
+
+	time.Sleep(500 * time.Millisecond)
+	resultMap, _, err = s.GetWindowMetricsMap(time.Second)
+	require.NoError(t, err)
+	metric, ok = resultMap[key.String()]
+	require.True(t, ok)
+	assert.EqualValues(t, 10, metric.MsgRate)
+	assert.True(t, metric.MsgRateEWMA < peak/100)
+}
+
+func TestSummary_DistinctActiveCounts(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []StateOption
+	}{
+		{
+			name: "exact",
+		},
+		{
+			name: "approximate",
+			opts: []StateOption{WithApproximateDistinct(12)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := Init(append(test.opts, WithExportInterval(10*time.Millisecond), WithInternalExporter())...)
+			require.NoError(t, err)
+			time.Sleep(50 * time.Millisecond)
+			_, _, cursor := s.Delta(nil)
+			for _, channel := range []string{"ch_1", "ch_2", "ch_3"} {
+				for _, kind := range []string{"publish", "subscribe"} {
+					key := GetKey("node_distinct_"+test.name, "client_distinct", channel, "g1", kind, "")
+					require.NoError(t, key.Record(Item{MsgCount: 1}))
+				}
+			}
+			require.NoError(t, GetKey("node_distinct_"+test.name, "client_distinct_2", "ch_1", "g2", "publish", "").Record(Item{MsgCount: 1}))
+			time.Sleep(100 * time.Millisecond)
+			resultMap, sum, _ := s.Delta(cursor)
+			require.Equal(t, 7, len(resultMap))
+			assert.EqualValues(t, 1, sum.TotalActiveNodes)
+			assert.EqualValues(t, 2, sum.TotalActiveClients)
+			assert.EqualValues(t, 3, sum.TotalActiveChannels)
+			assert.EqualValues(t, 4, sum.TotalActiveGroups)
+		})
+	}
+}
+
+func TestSummary_AddSummary(t *testing.T) {
+	var sum Summary
+	sum = sum.AddSummary(&ChannelSummary{Node: "node_1", TotalMsgCount: 2, TotalErrors: 1})
+	sum = sum.AddSummary(&ChannelSummary{Node: "node_1", TotalMsgCount: 2})
+	assert.Equal(t, "node_1", sum.Node)
+	assert.EqualValues(t, 4, sum.TotalMsgCount)
+	assert.EqualValues(t, 25, sum.ErrorRate)
+	assert.EqualValues(t, 2, sum.TotalActiveChannels)
+	assert.EqualValues(t, 2, sum.TotalActiveClients)
+}
+
+func TestHyperLogLog(t *testing.T) {
+	h := newHyperLogLog(12)
+	for i := 0; i < 100000; i++ {
+		h.add(fmt.Sprintf("client_%d", i))
+		h.add(fmt.Sprintf("client_%d", i/2))
+	}
+	assert.InEpsilon(t, 100000, h.count(), 0.05)
+}
+
+func TestStats_GroupBy(t *testing.T) {
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter())
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+	_, _, err = s.GroupBy(2*time.Minute, KeyChannel)
+	require.Error(t, err)
+	unknown, _ := tag.NewKey("group_by_unknown")
+	_, _, err = s.GroupBy(0, unknown)
+	require.Error(t, err)
+
+	keys := []Key{
+		GetKey("node_group_by", "client_group_by_1", "channel_group_by_1", "", "publish", ""),
+		GetKey("node_group_by", "client_group_by_1", "channel_group_by_2", "", "publish", ""),
+		GetKey("node_group_by", "client_group_by_2", "channel_group_by_1", "", "subscribe", ""),
+	}
+	require.NoError(t, keys[0].Record(Item{MsgCount: 1, MsgSize: 10, CacheHit: 1, Latency: 10 * time.Millisecond}))
+	require.NoError(t, keys[1].Record(Item{MsgCount: 2, MsgSize: 40, CacheMiss: 1, Latency: 20 * time.Millisecond}))
+	require.NoError(t, keys[2].Record(Item{MsgCount: 3, MsgSize: 90, CacheHit: 1, Latency: 30 * time.Millisecond}))
+	time.Sleep(100 * time.Millisecond)
+
+	resultMap, _, err := s.GroupBy(0, KeyChannel)
+	require.NoError(t, err)
+	channel := GetKey("", "", "channel_group_by_1", "", "", "")
+	metric, ok := resultMap[channel.String()]
+	require.True(t, ok)
+	assert.Equal(t, "channel_group_by_1", metric.Channel)
+	assert.Empty(t, metric.ClientID)
+	assert.EqualValues(t, 4, metric.TotalMsgCount)
+	assert.EqualValues(t, 100, metric.TotalMsgSize)
+	assert.EqualValues(t, 25, metric.AvgMsgSize)
+	assert.EqualValues(t, 1, metric.CacheHitsRatio)
+	assert.EqualValues(t, 10, metric.MinLatency)
+	assert.EqualValues(t, 30, metric.MaxLatency)
+	assert.EqualValues(t, 20, metric.AvgLatency)
+
+	resultMap, sum, err := s.GroupBy(0, KeyClientID, KeyKind)
+	require.NoError(t, err)
+	client := GetKey("", "client_group_by_1", "", "", "publish", "")
+	metric, ok = resultMap[client.String()]
+	require.True(t, ok)
+	assert.EqualValues(t, 3, metric.TotalMsgCount)
+	assert.EqualValues(t, 1, metric.TotalCacheHits)
+	assert.EqualValues(t, 1, metric.TotalCacheMiss)
+	assert.EqualValues(t, 0.5, metric.CacheHitsRatio)
+	assert.EqualValues(t, 15, metric.AvgLatency)
+	assert.True(t, sum.TotalActiveChannels >= 2)
+}
+
+func TestStats_GetJSONHandler(t *testing.T) {
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter())
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+	keys := []Key{
+		GetKey("node_json", "client_json_1", "channel_json_1", "", "publish", ""),
+		GetKey("node_json", "client_json_2", "channel_json_1", "", "publish", ""),
+		GetKey("node_json", "client_json_3", "channel_json_2", "", "subscribe", ""),
+	}
+	for i, key := range keys {
+		require.NoError(t, key.Record(Item{MsgCount: float64(i + 1), MsgSize: 10}))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	get := func(query string) (*httptest.ResponseRecorder, MetricsResponse) {
+		rec := httptest.NewRecorder()
+		s.GetJSONHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		var resp MetricsResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		}
+		return rec, resp
+	}
+
+	rec, resp := get("node=node_json&sort=total_msg_count&order=desc")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	require.Equal(t, 3, resp.Total)
+	assert.Equal(t, "client_json_3", resp.Channels[0].ClientID)
+	assert.Equal(t, "client_json_1", resp.Channels[2].ClientID)
+	assert.EqualValues(t, 6, resp.Summary.TotalMsgCount)
+	assert.EqualValues(t, 3, resp.Summary.TotalActiveClients)
+
+	_, resp = get("node=node_json&kind=publish&sort=client_id&limit=1&offset=1")
+	require.Equal(t, 2, resp.Total)
+	require.Len(t, resp.Channels, 1)
+	assert.Equal(t, "client_json_2", resp.Channels[0].ClientID)
+	assert.EqualValues(t, 3, resp.Summary.TotalMsgCount)
+
+	_, resp = get("client_id=client_json_1&client_id=client_json_3&group_by=node")
+	require.Equal(t, 1, resp.Total)
+	assert.EqualValues(t, 4, resp.Channels[0].TotalMsgCount)
+
+	_, resp = get("node=node_json&offset=5")
+	assert.Equal(t, 3, resp.Total)
+	assert.Empty(t, resp.Channels)
+
+	for _, query := range []string{"window=2m", "window=x", "sort=labels", "order=up", "limit=-1", "group_by=unknown", "unknown=1"} {
+		rec, _ = get(query)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+func TestStats_OnInterval(t *testing.T) {
+	s, err := Init(WithExportInterval(10 * time.Millisecond))
+	require.NoError(t, err)
+	require.Error(t, s.OnInterval(func(map[string]*ChannelSummary, Summary) {}))
+
+	s, err = Init(WithExportInterval(20*time.Millisecond), WithInternalExporter())
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+	var mu sync.Mutex
+	var calls []time.Time
+	var total float64
+	require.NoError(t, s.OnInterval(func(m map[string]*ChannelSummary, sum Summary) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, time.Now())
+		for _, cs := range m {
+			if cs.ClientID == "client_interval" {
+				total += cs.TotalMsgCount
+			}
+		}
+	}))
+	second := 0
+	require.NoError(t, s.OnInterval(func(map[string]*ChannelSummary, Summary) {
+		mu.Lock()
+		defer mu.Unlock()
+		second++
+	}))
+
+	key := GetKey("node_interval", "client_interval", "channel_interval", "", "publish", "")
+	for i := 0; i < 3; i++ {
+		require.NoError(t, key.Record(Item{MsgCount: 1}))
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// every interval is reported once, after all its views
+	assert.EqualValues(t, 3, total)
+	assert.True(t, len(calls) >= 5 && len(calls) <= 15, "%d calls", len(calls))
+	assert.Equal(t, len(calls), second)
+	for i := 1; i < len(calls); i++ {
+		assert.True(t, calls[i].Sub(calls[i-1]) > 10*time.Millisecond, "calls %s apart", calls[i].Sub(calls[i-1]))
+	}
+}
+
+func TestStats_Close(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	influxFile := filepath.Join(dir, "influx.txt")
+
+	// nothing is exported before Close
+	s, err := Init(WithExportInterval(time.Hour), WithInternalExporter(), WithInflux(InfluxOptions{File: influxFile}))
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+	var intervals []map[string]*ChannelSummary
+	require.NoError(t, s.OnInterval(func(m map[string]*ChannelSummary, sum Summary) {
+		intervals = append(intervals, m)
+	}))
+	events, _ := s.Subscribe(nil)
+
+	key1 := GetKey("node_close", "client_close_1", "channel_close", "", "publish", "")
+	key2 := GetKey("node_close", "client_close_2", "channel_close", "", "subscribe", "")
+	require.NoError(t, NewSet("set_close").Add(key1).Record(Item{MsgCount: 2}))
+	ReportMessageSubscribe(map[Key]struct{}{key2: {}}, 3, 30)
+
+	require.NoError(t, s.Close(context.Background()))
+	require.NoError(t, s.Close(context.Background()))
+
+	m, _ := s.Snapshot()
+	require.Contains(t, m, key1.String())
+	require.Contains(t, m, key2.String())
+	assert.EqualValues(t, 2, m[key1.String()].TotalMsgCount)
+	assert.EqualValues(t, 30, m[key2.String()].TotalMsgSize)
+	require.Len(t, intervals, 1)
+	assert.EqualValues(t, 3, intervals[0][key2.String()].TotalMsgCount)
+	data, err := ioutil.ReadFile(influxFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "client_id=client_close_1")
+	for range events {
+	}
+	for _, v := range s.views {
+		assert.Nil(t, view.Find(v.Name))
+	}
+
+	// recordings after Close are dropped
+	require.NoError(t, NewSet("set_close").Add(key1).Record(Item{MsgCount: 2}))
+	ReportMessageSubscribe(map[Key]struct{}{key2: {}}, 3, 30)
+	require.NoError(t, s.Record(key1, Item{MsgCount: 2}))
+}
+
+func TestSet_RecordReusedItems(t *testing.T) {
+	s, err := New(WithExportInterval(10*time.Millisecond), WithInternalExporter())
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+	key := GetKey("node_set_items", "client_set_items", "some_channel", "", "publish", "")
+	items := []Item{{MsgCount: 1}}
+	require.NoError(t, s.NewSet("set_items").Add(key).Record(items...))
+	items[0].MsgCount = 5
+	time.Sleep(100 * time.Millisecond)
+
+	m, _ := s.Snapshot()
+	require.Contains(t, m, key.String())
+	assert.EqualValues(t, 1, m[key.String()].TotalMsgCount)
+}
+
+func TestStats_CloseWhileRecording(t *testing.T) {
+	s, err := New(WithExportInterval(time.Hour), WithInternalExporter())
+	require.NoError(t, err)
+	set := s.NewSet("set_close_recording").Add(GetKey("node_close", "client_close", "channel_close", "", "publish", ""))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				set.Record(Item{MsgCount: 1})
+			}
+		}()
+	}
+	require.NoError(t, s.Close(context.Background()))
+	wg.Wait()
+}
+
+func TestStats_NewIsolated(t *testing.T) {
+	s1, err := New(WithExportInterval(10*time.Millisecond), WithInternalExporter())
+	require.NoError(t, err)
+	defer s1.Close(context.Background())
+	s2, err := New(WithExportInterval(10*time.Millisecond), WithInternalExporter())
+	require.NoError(t, err)
+	defer s2.Close(context.Background())
+	assert.NotEqual(t, s1, Default())
+	assert.NotEqual(t, s2, Default())
+
+	key := GetKey("node_isolated", "client_isolated", "some_channel", "", "publish", "")
+	require.NoError(t, s1.Record(key, Item{MsgCount: 1}))
+	require.NoError(t, s2.NewSet("set_isolated").Add(key).Record(Item{MsgCount: 2}))
+	time.Sleep(100 * time.Millisecond)
+
+	m1, _ := s1.Snapshot()
+	m2, _ := s2.Snapshot()
+	require.Contains(t, m1, key.String())
+	require.Contains(t, m2, key.String())
+	assert.EqualValues(t, 1, m1[key.String()].TotalMsgCount)
+	assert.EqualValues(t, 2, m2[key.String()].TotalMsgCount)
+}
+
+func TestStats_RecordCounts(t *testing.T) {
+	s, err := New(WithExportInterval(10*time.Millisecond), WithInternalExporter())
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+
+	item := Item{MsgCount: 1, Errors: 1000, CacheHit: 3, CacheMiss: 2}
+	ms := s.appendMeasurements(nil, item)
+	assert.Len(t, ms, 4)
+	allocs := testing.AllocsPerRun(100, func() {
+		ms = s.appendMeasurements(ms[:0], item)
+	})
+	assert.Zero(t, allocs)
+
+	key := GetKey("node_counts", "client_counts", "some_channel", "", "publish", "")
+	require.NoError(t, s.Record(key, item))
+	require.NoError(t, s.Record(key, item))
+	time.Sleep(100 * time.Millisecond)
+
+	m, _ := s.Snapshot()
+	require.Contains(t, m, key.String())
+	assert.EqualValues(t, 2000, m[key.String()].TotalErrors)
+	assert.EqualValues(t, 6, m[key.String()].TotalCacheHits)
+	assert.EqualValues(t, 4, m[key.String()].TotalCacheMiss)
+}
+
+func TestKey_RecordAllocs(t *testing.T) {
+	s, err := Init(WithExportInterval(time.Hour), WithInternalExporter())
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+	// OpenCensus allocates its request to the view worker, which then encodes
+	// the tags, so only the allocations of this package are counted: the
+	// measurements handed to the worker, once per recording
+	s.recorder = func(ctx context.Context, ms ...ocstats.Measurement) {}
+
+	key := GetKey("node_allocs", "client_allocs", "some_channel", "", "publish", "")
+	item := Item{MsgCount: 1, MsgSize: 100, CacheHit: 1, Errors: 1000, Latency: time.Millisecond}
+	require.NoError(t, key.Record(item))
+	allocs := testing.AllocsPerRun(1000, func() {
+		key.Record(item)
+	})
+	assert.EqualValues(t, 1, allocs)
+}
@@ -0,0 +1,238 @@
+package stats
+
+import (
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opencensus.io/stats/view"
+)
+
+const (
+	defaultStatsDAddress = "127.0.0.1:8125"
+	// defaultStatsDPacketSize fits a UDP payload in an ethernet MTU.
+	defaultStatsDPacketSize = 1432
+)
+
+// StatsDOptions configures the StatsD exporter enabled with WithStatsD.
+type StatsDOptions struct {
+	// Address of the agent, 127.0.0.1:8125 by default.
+	Address string
+	// Prefix is prepended, followed by a dot, to every metric name.
+	Prefix string
+	// Tags are added to the DogStatsD tags of every metric, as "name:value"
+	// or plain "name".
+	Tags []string
+	// MaxPacketSize is the maximum size of a UDP payload, 1432 by default.
+	MaxPacketSize int
+	// OnError is called when sending a packet fails, the error is logged by
+	// default.
+	OnError func(err error)
+}
+
+// statsdExporter pushes the views to a StatsD agent. Counts are sent as
+// counters of the change since the previous export, last values as gauges and
+// distributions as timers (latency) or histograms (message size), one line
+// per bucket with a sample rate telling how many values it stands for. The
+// key fields and labels are sent as DogStatsD tags.
+type statsdExporter struct {
+	sync.Mutex
+	opts StatsDOptions
+	conn net.Conn
+	tags string
+	buf  []byte
+	prev map[aggIndex]interface{}
+}
+
+func newStatsDExporter(opts StatsDOptions) (*statsdExporter, error) {
+	if opts.Address == "" {
+		opts.Address = defaultStatsDAddress
+	}
+	if opts.MaxPacketSize <= 0 {
+		opts.MaxPacketSize = defaultStatsDPacketSize
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(err error) {
+			log.Printf("Failed to export to StatsD: %v", err)
+		}
+	}
+	conn, err := net.Dial("udp", opts.Address)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]string, len(opts.Tags))
+	for i, t := range opts.Tags {
+		tags[i] = sanitizeStatsD(t, ",|@#\n")
+	}
+	return &statsdExporter{
+		opts: opts,
+		conn: conn,
+		tags: strings.Join(tags, ","),
+		buf:  make([]byte, 0, opts.MaxPacketSize),
+		prev: make(map[aggIndex]interface{}),
+	}, nil
+}
+
+func (e *statsdExporter) ExportView(vd *view.Data) {
+	st, ok := statTypeOf(vd.View.Name)
+	if !ok {
+		return
+	}
+	name := sanitizeStatsD(vd.View.Name, ":|@#,\n")
+	if e.opts.Prefix != "" {
+		name = e.opts.Prefix + "." + name
+	}
+	e.Lock()
+	defer e.Unlock()
+	seen := make(map[aggIndex]bool, len(vd.Rows))
+	for _, row := range vd.Rows {
+		key := makeKeyFromTags(row.Tags)
+		index := aggIndex{key: key, st: st}
+		seen[index] = true
+		tags := e.keyTags(key)
+		switch v := row.Data.(type) {
+		case *view.CountData:
+			prev, _ := e.prev[index].(int64)
+			e.prev[index] = v.Value
+			if v.Value < prev {
+				prev = 0
+			}
+			if diff := v.Value - prev; diff > 0 {
+				e.write(name, strconv.FormatInt(diff, 10), "c", 1, tags)
+			}
+		case *view.SumData:
+			prev, _ := e.prev[index].(float64)
+			e.prev[index] = v.Value
+			if v.Value < prev {
+				prev = 0
+			}
+			if diff := v.Value - prev; diff > 0 {
+				e.write(name, formatStatsD(diff), "c", 1, tags)
+			}
+		case *view.LastValueData:
+			e.write(name, formatStatsD(v.Value), "g", 1, tags)
+		case *view.DistributionData:
+			typ := "ms"
+			if st == typeMsgSizeDist {
+				typ = "h"
+			}
+			h := newHistogram(vd.View.Aggregation.Buckets, v)
+			prev, _ := e.prev[index].(*histogram)
+			e.prev[index] = h
+			e.writeHistogram(name, typ, h.sub(prev), tags)
+		}
+	}
+	// forget the rows of the evicted keys
+	for index := range e.prev {
+		if index.st == st && !seen[index] {
+			delete(e.prev, index)
+		}
+	}
+	e.flush()
+}
+
+// writeHistogram writes a line per non-empty bucket of h, valued at the mean
+// of h when it has a single non-empty bucket and at the middle of the bucket
+// otherwise.
+func (e *statsdExporter) writeHistogram(name, typ string, h *histogram, tags string) {
+	if h.isEmpty() {
+		return
+	}
+	var buckets int
+	for _, c := range h.counts {
+		if c > 0 {
+			buckets++
+		}
+	}
+	if buckets <= 1 {
+		e.write(name, formatStatsD(h.mean()), typ, h.count, tags)
+		return
+	}
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		lo := math.Max(h.lower(i), h.min)
+		hi := math.Min(h.upper(i), h.max)
+		e.write(name, formatStatsD((lo+hi)/2), typ, c, tags)
+	}
+}
+
+// write appends a line standing for count values to the packet, sending the
+// packet first when the line does not fit in it.
+func (e *statsdExporter) write(name, value, typ string, count int64, tags string) {
+	line := make([]byte, 0, len(name)+len(value)+len(tags)+16)
+	line = append(line, name...)
+	line = append(line, ':')
+	line = append(line, value...)
+	line = append(line, '|')
+	line = append(line, typ...)
+	if count > 1 {
+		line = append(line, "|@"...)
+		line = strconv.AppendFloat(line, 1/float64(count), 'g', -1, 64)
+	}
+	if tags != "" {
+		line = append(line, "|#"...)
+		line = append(line, tags...)
+	}
+	if len(e.buf) > 0 && len(e.buf)+1+len(line) > e.opts.MaxPacketSize {
+		e.flush()
+	}
+	if len(e.buf) > 0 {
+		e.buf = append(e.buf, '\n')
+	}
+	e.buf = append(e.buf, line...)
+}
+
+func (e *statsdExporter) flush() {
+	if len(e.buf) == 0 {
+		return
+	}
+	if _, err := e.conn.Write(e.buf); err != nil {
+		e.opts.OnError(err)
+	}
+	e.buf = e.buf[:0]
+}
+
+// keyTags returns the DogStatsD tags of the non-empty fields and labels of key
+// followed by the constant tags.
+func (e *statsdExporter) keyTags(key Key) string {
+	var tags []string
+	for i, value := range key.fields() {
+		if value != "" {
+			tags = append(tags, fieldKeys[i].Name()+":"+sanitizeStatsD(value, ",|@#\n"))
+		}
+	}
+	for _, l := range key.Labels() {
+		tags = append(tags, sanitizeStatsD(l.Name, ",|@#:\n")+":"+sanitizeStatsD(l.Value, ",|@#\n"))
+	}
+	if e.tags != "" {
+		tags = append(tags, e.tags)
+	}
+	return strings.Join(tags, ",")
+}
+
+func (e *statsdExporter) close() error {
+	e.Lock()
+	defer e.Unlock()
+	e.flush()
+	return e.conn.Close()
+}
+
+// sanitizeStatsD replaces the characters of special, which delimit the parts
+// of a line, with underscores.
+func sanitizeStatsD(s, special string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(special, r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func formatStatsD(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
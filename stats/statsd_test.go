@@ -0,0 +1,99 @@
+package stats
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func listenStatsD(t *testing.T) (*net.UDPConn, func(time.Duration) []string) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	read := func(d time.Duration) []string {
+		var lines []string
+		buf := make([]byte, 65536)
+		deadline := time.Now().Add(d)
+		for {
+			conn.SetReadDeadline(deadline)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return lines
+			}
+			lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+		}
+	}
+	return conn, read
+}
+
+func TestStatsD_Export(t *testing.T) {
+	conn, read := listenStatsD(t)
+	defer conn.Close()
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithStatsD(StatsDOptions{
+		Address: conn.LocalAddr().String(),
+		Prefix:  "kubemq",
+		Tags:    []string{"env:test"},
+	}))
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+
+	key := GetKey("node_statsd", "client_statsd", "some,channel", "", "publish", "")
+	require.NoError(t, key.Record(Item{MsgCount: 3, MsgSize: 30, Errors: 1, Latency: 10 * time.Millisecond}))
+	lines := read(200 * time.Millisecond)
+	tags := "|#node:node_statsd,client_id:client_statsd,channel:some_channel,kind:publish,env:test"
+	assert.Contains(t, lines, "kubemq.total_messages:3|c"+tags)
+	assert.Contains(t, lines, "kubemq.total_message_size:30|c"+tags)
+	assert.Contains(t, lines, "kubemq.total_errors:1|c"+tags)
+	assert.Contains(t, lines, "kubemq.total_latency:10|ms"+tags)
+	assert.Contains(t, lines, "kubemq.message_size_distribution:30|h"+tags)
+
+	// only the changes are sent again
+	require.NoError(t, key.Record(Item{MsgCount: 2}))
+	lines = read(200 * time.Millisecond)
+	assert.Contains(t, lines, "kubemq.total_messages:2|c"+tags)
+	for _, line := range lines {
+		if strings.HasSuffix(line, tags) {
+			assert.False(t, strings.HasPrefix(line, "kubemq.total_errors"), line)
+		}
+	}
+}
+
+func TestStatsD_Batching(t *testing.T) {
+	conn, _ := listenStatsD(t)
+	defer conn.Close()
+	e, err := newStatsDExporter(StatsDOptions{Address: conn.LocalAddr().String(), MaxPacketSize: 100})
+	require.NoError(t, err)
+	defer e.close()
+
+	v := &view.View{Name: typeLatency.String(), TagKeys: Keys, Aggregation: view.Distribution(10, 20)}
+	vd := &view.Data{View: v}
+	for _, client := range []string{"client_1", "client_2", "client_3"} {
+		vd.Rows = append(vd.Rows, &view.Row{
+			Tags: []tag.Tag{{Key: KeyClientID, Value: client}},
+			Data: &view.DistributionData{Count: 4, Min: 5, Max: 25, Mean: 15, CountPerBucket: []int64{1, 2, 1}},
+		})
+	}
+	e.ExportView(vd)
+
+	buf := make([]byte, 65536)
+	var lines []string
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		assert.True(t, n <= 100, "packet of %d bytes", n)
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	require.Len(t, lines, 9)
+	assert.Contains(t, lines, "total_latency:7.5|ms|#client_id:client_1")
+	assert.Contains(t, lines, "total_latency:15|ms|@0.5|#client_id:client_2")
+	assert.Contains(t, lines, "total_latency:22.5|ms|#client_id:client_3")
+}
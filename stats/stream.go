@@ -0,0 +1,198 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opencensus.io/tag"
+)
+
+// streamBuffer is the number of events a subscriber can lag behind before the
+// following ones are dropped.
+const streamBuffer = 8
+
+// StreamEvent is the summaries of the keys that changed during an export
+// interval, sent to the subscribers of Subscribe and GetStreamHandler.
+type StreamEvent struct {
+	Time time.Time `json:"time"`
+	// Summary is computed over Channels like the one of GetJSONHandler.
+	Summary  Summary           `json:"summary"`
+	Channels []*ChannelSummary `json:"channels"`
+	// Dropped is the number of events dropped since the previous one because
+	// the subscriber did not keep up.
+	Dropped uint64 `json:"dropped"`
+}
+
+// streamBroker fans the summaries of every reporting cycle out to the
+// subscribers once the internal exporter received all its views. It never
+// waits for a subscriber: the events a subscriber has no room for are dropped
+// and counted.
+type streamBroker struct {
+	aggMap *aggMap
+
+	mu     sync.Mutex
+	subs   map[*streamSubscriber]struct{}
+	closed bool
+}
+
+type streamSubscriber struct {
+	match   func(Key) bool
+	events  chan *StreamEvent
+	dropped uint64
+}
+
+func newStreamBroker(e *exporter) *streamBroker {
+	b := &streamBroker{
+		aggMap: e.aggMap,
+		subs:   make(map[*streamSubscriber]struct{}),
+	}
+	e.onCycle(b.publish)
+	return b
+}
+
+func (b *streamBroker) subscribe(match func(Key) bool) *streamSubscriber {
+	sub := &streamSubscriber{
+		match:  match,
+		events: make(chan *StreamEvent, streamBuffer),
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.events)
+		return sub
+	}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+func (b *streamBroker) unsubscribe(sub *streamSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; !ok {
+		return
+	}
+	delete(b.subs, sub)
+	close(sub.events)
+}
+
+// close ends the subscriptions and refuses the following ones.
+func (b *streamBroker) close() {
+	b.mu.Lock()
+	b.closed = true
+	subs := make([]*streamSubscriber, 0, len(b.subs))
+	for sub := range b.subs {
+		subs = append(subs, sub)
+	}
+	b.mu.Unlock()
+	for _, sub := range subs {
+		b.unsubscribe(sub)
+	}
+}
+
+// publish sends every subscriber the summaries of its keys that changed during
+// the cycle ending at until.
+func (b *streamBroker) publish(since, until *Cursor) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		m, sum := b.aggMap.GetDeltaQuery(since, until, query{match: sub.match})
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		ev := &StreamEvent{Time: until.Time(), Summary: sum, Channels: make([]*ChannelSummary, 0, len(names))}
+		for _, name := range names {
+			ev.Channels = append(ev.Channels, m[name])
+		}
+		ev.Dropped = sub.dropped
+		select {
+		case sub.events <- ev:
+			sub.dropped = 0
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the summaries of the keys that changed
+// during every export interval and kept by match, all of them when match is
+// nil, and the function ending the subscription. Events are dropped rather
+// than delayed when the receiver falls behind. It is meant to push the
+// metrics to clients, for instance over a WebSocket; the channel is closed
+// when the subscription ends or s is closed.
+func (s *Stats) Subscribe(match func(Key) bool) (<-chan *StreamEvent, func()) {
+	if s.stream == nil {
+		events := make(chan *StreamEvent)
+		close(events)
+		return events, func() {}
+	}
+	sub := s.stream.subscribe(match)
+	return sub.events, func() {
+		s.stream.unsubscribe(sub)
+	}
+}
+
+// GetStreamHandler returns a handler streaming the events of Subscribe as
+// server-sent events named summaries, with a StreamEvent as JSON data. Like
+// for GetJSONHandler, the query parameters name key fields or declared tag
+// keys and keep the keys having one of the given values.
+func (s *Stats) GetStreamHandler() http.Handler {
+	return &streamHandler{stats: s}
+}
+
+type streamHandler struct {
+	stats *Stats
+}
+
+func (h *streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.stats.stream == nil {
+		http.Error(w, "stats: internal exporter is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "stats: streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	filters := make(map[tag.Key]map[string]bool)
+	for name, values := range r.URL.Query() {
+		if err := addFilter(h.stats.declared, filters, name, values); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	events, cancel := h.stats.Subscribe(filterMatch(filters))
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return
+			}
+			if _, err := w.Write([]byte("event: summaries\ndata: " + string(data) + "\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
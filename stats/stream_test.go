@@ -0,0 +1,94 @@
+package stats
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats_GetStreamHandler(t *testing.T) {
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter())
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+	server := httptest.NewServer(s.GetStreamHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?node=node_stream&client_id=client_stream_2")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	require.NoError(t, GetKey("node_stream", "client_stream_1", "channel_stream", "", "publish", "").Record(Item{MsgCount: 1}))
+	require.NoError(t, GetKey("node_stream", "client_stream_2", "channel_stream", "", "publish", "").Record(Item{MsgCount: 2, MsgSize: 20, Latency: 5 * time.Millisecond}))
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 1<<20)
+	deadline := time.Now().Add(2 * time.Second)
+	var ev StreamEvent
+	for scanner.Scan() && time.Now().Before(deadline) {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev))
+		if len(ev.Channels) > 0 {
+			break
+		}
+	}
+	require.Len(t, ev.Channels, 1)
+	assert.Equal(t, "client_stream_2", ev.Channels[0].ClientID)
+	assert.EqualValues(t, 2, ev.Channels[0].TotalMsgCount)
+	assert.EqualValues(t, 2, ev.Summary.TotalMsgCount)
+	assert.EqualValues(t, 20, ev.Summary.TotalMsgSize)
+	assert.EqualValues(t, 1, ev.Summary.TotalActiveChannels)
+	assert.EqualValues(t, 1, ev.Summary.TotalActiveClients)
+	assert.NotZero(t, ev.Summary.LatencyP50)
+	assert.Equal(t, ev.Channels[0].LatencyP50, ev.Summary.LatencyP50)
+	assert.Equal(t, ev.Channels[0].MaxMsgSize, ev.Summary.MaxMsgSize)
+
+	rec := httptest.NewRecorder()
+	s.GetStreamHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?unknown=1", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestStats_SubscribeSlowConsumer(t *testing.T) {
+	s, err := Init(WithExportInterval(10*time.Millisecond), WithInternalExporter())
+	require.NoError(t, err)
+	defer s.Close(context.Background())
+
+	slow, cancelSlow := s.Subscribe(nil)
+	fast, cancelFast := s.Subscribe(nil)
+	defer cancelFast()
+	// the fast subscriber keeps receiving while the slow one is stalled
+	received := 0
+	for received < 3*streamBuffer {
+		select {
+		case <-fast:
+			received++
+		case <-time.After(time.Second):
+			t.Fatal("fast subscriber blocked by the slow one")
+		}
+	}
+	for i := 0; i < streamBuffer; i++ {
+		ev := <-slow
+		assert.Zero(t, ev.Dropped)
+	}
+	select {
+	case ev := <-slow:
+		assert.NotZero(t, ev.Dropped)
+	case <-time.After(time.Second):
+		t.Fatal("no event after the dropped ones")
+	}
+	cancelSlow()
+	for range slow {
+	}
+}
@@ -3,6 +3,8 @@ package stats
 import (
 	"fmt"
 	"time"
+
+	"go.opencensus.io/tag"
 )
 
 type Summary struct {
@@ -16,11 +18,43 @@ type Summary struct {
 	TotalErrors         int64   `json:"total_errors"`
 	TotalActiveChannels int64   `json:"total_active_channels"`
 	TotalActiveClients  int64   `json:"total_active_clients"`
+	TotalActiveGroups   int64   `json:"total_active_groups"`
+	TotalActiveNodes    int64   `json:"total_active_nodes"`
+	MsgRate             float64 `json:"msg_rate"`
+	ByteRate            float64 `json:"byte_rate"`
+	ErrorsPerSec        float64 `json:"errors_per_sec"`
+	MsgRateEWMA         float64 `json:"msg_rate_ewma"`
+	ByteRateEWMA        float64 `json:"byte_rate_ewma"`
+	ErrorsPerSecEWMA    float64 `json:"errors_per_sec_ewma"`
 	SuccessRate         float64 `json:"success_rate"`
 	ErrorRate           float64 `json:"error_rate"`
+	AvgLatency          float64 `json:"avg_latency"`
+	MinLatency          float64 `json:"min_latency"`
+	MaxLatency          float64 `json:"max_latency"`
+	LatencyP50          float64 `json:"latency_p50"`
+	LatencyP90          float64 `json:"latency_p90"`
+	LatencyP95          float64 `json:"latency_p95"`
+	LatencyP99          float64 `json:"latency_p99"`
+	MaxMsgSize          float64 `json:"max_msg_size"`
+	MsgSizeP50          float64 `json:"msg_size_p50"`
+	MsgSizeP90          float64 `json:"msg_size_p90"`
+	MsgSizeP95          float64 `json:"msg_size_p95"`
+	MsgSizeP99          float64 `json:"msg_size_p99"`
 }
 
+// AddSummary adds the totals of cs to s and counts its channel and client as
+// active ones.
 func (s Summary) AddSummary(cs *ChannelSummary) Summary {
+	s = s.addTotals(cs)
+	s.TotalActiveChannels++
+	s.TotalActiveClients++
+	return s
+}
+
+// addTotals adds the totals of cs to s. The active counts are left alone, a
+// single ChannelSummary cannot tell whether its client or channel was already
+// counted; they are computed from the distinct keys of an aggregation.
+func (s Summary) addTotals(cs *ChannelSummary) Summary {
 	if s.Node == "" {
 		s.Node = cs.Node
 	}
@@ -39,31 +73,53 @@ func (s Summary) AddSummary(cs *ChannelSummary) Summary {
 	if s.TotalCacheHits+s.TotalCacheMiss > 0 {
 		s.CacheHitsRatio = float64(s.TotalCacheHits) / float64(s.TotalCacheHits+s.TotalCacheMiss)
 	}
-	s.TotalActiveChannels++
-	s.TotalActiveClients++
+	s.MsgRate += cs.MsgRate
+	s.ByteRate += cs.ByteRate
+	s.ErrorsPerSec += cs.ErrorsPerSec
+	s.MsgRateEWMA += cs.MsgRateEWMA
+	s.ByteRateEWMA += cs.ByteRateEWMA
+	s.ErrorsPerSecEWMA += cs.ErrorsPerSecEWMA
 
 	return s
 
 }
 
 type ChannelSummary struct {
-	Node            string    `json:"node"`
-	Channel         string    `json:"channel"`
-	Group           string    `json:"group"`
-	ClientID        string    `json:"client_id"`
-	Kind            string    `json:"kind"`
-	TotalMsgCount   float64   `json:"total_msg_count"`
-	TotalMsgSize    float64   `json:"total_msg_size"`
-	AvgMsgSize      float64   `json:"avg_msg_size"`
-	TotalCacheHits  int64     `json:"total_cache_hits"`
-	TotalCacheMiss  int64     `json:"total_cache_miss"`
-	CacheHitsRatio  float64   `json:"cache_hits_ratio"`
-	TotalErrors     int64     `json:"total_errors"`
-	AvgLatency      float64   `json:"avg_latency"`
-	SuccessRate     float64   `json:"success_rate"`
-	ErrorRate       float64   `json:"error_rate"`
-	LastUpdatedUnix int64     `json:"last_updated_unix"`
-	LastUpdateTime  time.Time `json:"last_update_time"`
+	Node             string            `json:"node"`
+	Channel          string            `json:"channel"`
+	Group            string            `json:"group"`
+	ClientID         string            `json:"client_id"`
+	Kind             string            `json:"kind"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	TotalMsgCount    float64           `json:"total_msg_count"`
+	TotalMsgSize     float64           `json:"total_msg_size"`
+	AvgMsgSize       float64           `json:"avg_msg_size"`
+	MaxMsgSize       float64           `json:"max_msg_size"`
+	MsgSizeP50       float64           `json:"msg_size_p50"`
+	MsgSizeP90       float64           `json:"msg_size_p90"`
+	MsgSizeP95       float64           `json:"msg_size_p95"`
+	MsgSizeP99       float64           `json:"msg_size_p99"`
+	TotalCacheHits   int64             `json:"total_cache_hits"`
+	TotalCacheMiss   int64             `json:"total_cache_miss"`
+	CacheHitsRatio   float64           `json:"cache_hits_ratio"`
+	TotalErrors      int64             `json:"total_errors"`
+	MsgRate          float64           `json:"msg_rate"`
+	ByteRate         float64           `json:"byte_rate"`
+	ErrorsPerSec     float64           `json:"errors_per_sec"`
+	MsgRateEWMA      float64           `json:"msg_rate_ewma"`
+	ByteRateEWMA     float64           `json:"byte_rate_ewma"`
+	ErrorsPerSecEWMA float64           `json:"errors_per_sec_ewma"`
+	AvgLatency       float64           `json:"avg_latency"`
+	MinLatency       float64           `json:"min_latency"`
+	MaxLatency       float64           `json:"max_latency"`
+	LatencyP50       float64           `json:"latency_p50"`
+	LatencyP90       float64           `json:"latency_p90"`
+	LatencyP95       float64           `json:"latency_p95"`
+	LatencyP99       float64           `json:"latency_p99"`
+	SuccessRate      float64           `json:"success_rate"`
+	ErrorRate        float64           `json:"error_rate"`
+	LastUpdatedUnix  int64             `json:"last_updated_unix"`
+	LastUpdateTime   time.Time         `json:"last_update_time"`
 }
 
 func NewChannelSummary(key Key) *ChannelSummary {
@@ -77,6 +133,7 @@ func NewChannelSummary(key Key) *ChannelSummary {
 		Group:           key.Group(),
 		ClientID:        key.ClientID(),
 		Kind:            fmt.Sprintf("%s%s", key.Kind(), subKind),
+		Labels:          labelsMap(key.Labels()),
 		TotalMsgCount:   0,
 		TotalMsgSize:    0,
 		AvgMsgSize:      0,
@@ -91,3 +148,192 @@ func NewChannelSummary(key Key) *ChannelSummary {
 		LastUpdateTime:  time.Time{},
 	}
 }
+
+func labelsMap(labels []Label) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(labels))
+	for _, l := range labels {
+		m[l.Name] = l.Value
+	}
+	return m
+}
+
+func (cs *ChannelSummary) calc(span time.Duration) {
+	cs.MsgRate = perSecond(cs.TotalMsgCount, span)
+	cs.ByteRate = perSecond(cs.TotalMsgSize, span)
+	cs.ErrorsPerSec = perSecond(float64(cs.TotalErrors), span)
+	if cs.TotalMsgCount > 0 {
+		cs.AvgMsgSize = cs.TotalMsgSize / cs.TotalMsgCount
+		cs.ErrorRate = float64(cs.TotalErrors) / cs.TotalMsgCount * 100
+	}
+	cs.SuccessRate = 100 - cs.ErrorRate
+	if cs.TotalCacheHits+cs.TotalCacheMiss > 0 {
+		cs.CacheHitsRatio = float64(cs.TotalCacheHits) / float64(cs.TotalCacheHits+cs.TotalCacheMiss)
+	}
+}
+
+func (cs *ChannelSummary) setLatency(h *histogram) {
+	if h.isEmpty() {
+		return
+	}
+	cs.AvgLatency = h.mean()
+	cs.MinLatency = h.min
+	cs.MaxLatency = h.max
+	cs.LatencyP50 = h.percentile(50)
+	cs.LatencyP90 = h.percentile(90)
+	cs.LatencyP95 = h.percentile(95)
+	cs.LatencyP99 = h.percentile(99)
+}
+
+func (cs *ChannelSummary) setMsgSize(h *histogram) {
+	if h.isEmpty() {
+		return
+	}
+	cs.MaxMsgSize = h.max
+	cs.MsgSizeP50 = h.percentile(50)
+	cs.MsgSizeP90 = h.percentile(90)
+	cs.MsgSizeP95 = h.percentile(95)
+	cs.MsgSizeP99 = h.percentile(99)
+}
+
+func (s *Summary) setLatency(h *histogram) {
+	if h.isEmpty() {
+		return
+	}
+	s.AvgLatency = h.mean()
+	s.MinLatency = h.min
+	s.MaxLatency = h.max
+	s.LatencyP50 = h.percentile(50)
+	s.LatencyP90 = h.percentile(90)
+	s.LatencyP95 = h.percentile(95)
+	s.LatencyP99 = h.percentile(99)
+}
+
+func (s *Summary) setMsgSize(h *histogram) {
+	if h.isEmpty() {
+		return
+	}
+	s.MaxMsgSize = h.max
+	s.MsgSizeP50 = h.percentile(50)
+	s.MsgSizeP90 = h.percentile(90)
+	s.MsgSizeP95 = h.percentile(95)
+	s.MsgSizeP99 = h.percentile(99)
+}
+
+// query selects and groups the keys folded by a summaryBuilder.
+type query struct {
+	// match selects the keys to include, every key when nil.
+	match func(Key) bool
+	// dims groups the keys by these dimensions when not nil.
+	dims []tag.Key
+}
+
+// key returns the key k is folded into, reporting whether k is selected.
+func (q query) key(k Key) (Key, bool) {
+	if q.match != nil && !q.match(k) {
+		return Key{}, false
+	}
+	if q.dims != nil {
+		return k.project(q.dims), true
+	}
+	return k, true
+}
+
+// summaryBuilder folds aggregated values into channel summaries. Histograms are
+// kept aside so the Summary percentiles are computed over the merged buckets
+// rather than averaged from the channel ones.
+type summaryBuilder struct {
+	active  *activeCounters
+	query   query
+	metrics map[string]*ChannelSummary
+	latency map[string]*histogram
+	msgSize map[string]*histogram
+}
+
+func newSummaryBuilder(newCounter func() distinctCounter, q query) *summaryBuilder {
+	return &summaryBuilder{
+		active:  newActiveCounters(newCounter),
+		query:   q,
+		metrics: make(map[string]*ChannelSummary),
+		latency: make(map[string]*histogram),
+		msgSize: make(map[string]*histogram),
+	}
+}
+
+func (b *summaryBuilder) add(key Key, st statType, value interface{}) {
+	folded, ok := b.query.key(key)
+	if !ok {
+		return
+	}
+	b.active.add(key)
+	key = folded
+	index := key.String()
+	metric, ok := b.metrics[index]
+	if !ok {
+		metric = NewChannelSummary(key)
+		b.metrics[index] = metric
+	}
+	switch st {
+	case typeMsgCount:
+		metric.TotalMsgCount += value.(float64)
+	case typeMsgSize:
+		metric.TotalMsgSize += value.(float64)
+	case typeCacheHits:
+		metric.TotalCacheHits += value.(int64)
+	case typeCacheMiss:
+		metric.TotalCacheMiss += value.(int64)
+	case typeErrors:
+		metric.TotalErrors += value.(int64)
+	case typeLatency:
+		b.latency[index] = b.latency[index].merge(value.(*histogram))
+	case typeMsgSizeDist:
+		b.msgSize[index] = b.msgSize[index].merge(value.(*histogram))
+	case typeLastUpdate:
+		if lastUpdate := int64(value.(float64)); lastUpdate > metric.LastUpdatedUnix {
+			metric.LastUpdatedUnix = lastUpdate
+			metric.LastUpdateTime = time.Unix(metric.LastUpdatedUnix, 0)
+		}
+	}
+}
+
+// addRate sets the smoothed rate of st, which is kept by the aggregator
+// itself rather than computed over the span of the build.
+func (b *summaryBuilder) addRate(key Key, st statType, rate float64) {
+	key, ok := b.query.key(key)
+	if !ok {
+		return
+	}
+	metric, ok := b.metrics[key.String()]
+	if !ok {
+		return
+	}
+	switch st {
+	case typeMsgCount:
+		metric.MsgRateEWMA += rate
+	case typeMsgSize:
+		metric.ByteRateEWMA += rate
+	case typeErrors:
+		metric.ErrorsPerSecEWMA += rate
+	}
+}
+
+// build computes the derived values of the summaries. span is the wall-clock
+// time the aggregated values were collected over.
+func (b *summaryBuilder) build(span time.Duration) (map[string]*ChannelSummary, Summary) {
+	summery := Summary{}
+	var latency, msgSize *histogram
+	for index, metric := range b.metrics {
+		metric.calc(span)
+		metric.setLatency(b.latency[index])
+		metric.setMsgSize(b.msgSize[index])
+		latency = latency.merge(b.latency[index])
+		msgSize = msgSize.merge(b.msgSize[index])
+		summery = summery.addTotals(metric)
+	}
+	b.active.set(&summery)
+	summery.setLatency(latency)
+	summery.setMsgSize(msgSize)
+	return b.metrics, summery
+}
@@ -0,0 +1,70 @@
+package stats
+
+import "time"
+
+var defaultWindows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// maxCheckpoints bounds the history kept per aggregator for the longest window.
+const maxCheckpoints = 180
+
+type checkpoint struct {
+	at    time.Time
+	value interface{}
+}
+
+// history keeps the cumulative values of an aggregator at a fixed resolution,
+// long enough to answer the longest rolling window. A window is accurate to
+// the resolution: its start falls on the latest checkpoint at or before now
+// minus the window.
+type history struct {
+	points []checkpoint
+}
+
+func (h *history) add(at time.Time, value interface{}, resolution, retention time.Duration) {
+	if n := len(h.points); n > 0 && at.Sub(h.points[n-1].at) < resolution {
+		return
+	}
+	h.points = append(h.points, checkpoint{at: at, value: value})
+	cut := 0
+	for cut+1 < len(h.points) && !h.points[cut+1].at.After(at.Add(-retention)) {
+		cut++
+	}
+	if cut > 0 {
+		h.points = append(h.points[:0], h.points[cut:]...)
+	}
+}
+
+// valueAt returns the cumulative value at t, nil when the history starts
+// after t.
+func (h *history) valueAt(t time.Time) interface{} {
+	var value interface{}
+	for _, p := range h.points {
+		if p.at.After(t) {
+			break
+		}
+		value = p.value
+	}
+	return value
+}
+
+// windowResolution returns the interval between checkpoints and how long they
+// are kept for the given windows.
+func windowResolution(windows []time.Duration) (resolution, retention time.Duration) {
+	if len(windows) == 0 {
+		return 0, 0
+	}
+	shortest := windows[0]
+	for _, w := range windows {
+		if w > retention {
+			retention = w
+		}
+		if w < shortest {
+			shortest = w
+		}
+	}
+	resolution = shortest / 12
+	if min := retention / maxCheckpoints; resolution < min {
+		resolution = min
+	}
+	return resolution, retention
+}